@@ -0,0 +1,133 @@
+package ffi
+
+// #include "ffi.h"
+import "C"
+
+import (
+	"fmt"
+	"unsafe"
+)
+
+// cffi_bitfield describes a bitfield member of a C struct.
+// It shares the ffi_type of its underlying integer type.
+type cffi_bitfield struct {
+	cffi_type
+	base Type
+	bits int
+}
+
+// NewBitfieldType returns the type of a struct bitfield of the given width,
+// in bits, and of the given underlying integer type.
+// For example, NewBitfieldType(C_uint, 3) describes 'unsigned int f:3'.
+// A zero width declares an unnamed 'T :0' bitfield, which aligns the next
+// bitfield on the alignment of T.
+func NewBitfieldType(base Type, bits int) (Type, error) {
+	if k := base.Kind(); !is_signed(k) && !is_unsigned(k) {
+		return nil, fmt.Errorf("ffi.NewBitfieldType: invalid bitfield type [%s]", base.Name())
+	}
+	if bits < 0 || bits > 8*int(base.Size()) {
+		return nil, fmt.Errorf("ffi.NewBitfieldType: invalid width %d for bitfield type [%s]", bits, base.Name())
+	}
+	n := fmt.Sprintf("%s:%d", base.Name(), bits)
+	r := registry_of(base)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if t := r.type_by_name(n); t != nil {
+		return t, nil
+	}
+	t := &cffi_bitfield{
+		cffi_type: cffi_type{n, base.cptr(), base.GoType()},
+		base:      base,
+		bits:      bits,
+	}
+	r.register(t)
+	return t, nil
+}
+
+// is_bitfield returns whether t is a bitfield type
+func is_bitfield(t Type) bool {
+	_, ok := t.(*cffi_bitfield)
+	return ok
+}
+
+// g_big_endian is true on big-endian platforms, where bitfields are
+// allocated from the most significant bit of a byte.
+var g_big_endian = func() bool {
+	x := uint16(1)
+	return *(*byte)(unsafe.Pointer(&x)) == 0
+}()
+
+// bitfield returns the bitfield described by f within the struct or union
+// value v.
+func (v Value) bitfield(f StructField) (unsafe.Pointer, *cffi_bitfield) {
+	bf, ok := f.Type.(*cffi_bitfield)
+	if !ok {
+		panic("ffi: field [" + f.Name + "] is not a bitfield")
+	}
+	return unsafe.Pointer(uintptr(v.val) + f.Offset), bf
+}
+
+// bit returns the address of the byte holding the n'th bit allocated from
+// ptr, and the mask of that bit.
+func bit(ptr unsafe.Pointer, n int) (*byte, byte) {
+	p := (*byte)(unsafe.Pointer(uintptr(ptr) + uintptr(n/8)))
+	if g_big_endian {
+		return p, 0x80 >> uint(n%8)
+	}
+	return p, 1 << uint(n%8)
+}
+
+// value_bit returns the bit of the value of a bitfield of the given width
+// which is allocated as the i'th bit of the bitfield.
+func value_bit(i, bits int) uint64 {
+	if g_big_endian {
+		return 1 << uint(bits-1-i)
+	}
+	return 1 << uint(i)
+}
+
+// Bitfield returns the value of the i'th field of the struct or union v,
+// a bitfield.
+// The value is sign-extended if the type of the bitfield is signed.
+// It panics if v's Kind is not Struct or Union or if the field is not a
+// bitfield.
+func (v Value) Bitfield(i int) int64 {
+	v.mustBeStructOrUnion()
+	f := v.typ.Field(i)
+	ptr, bf := v.bitfield(f)
+	if bf.bits == 0 {
+		return 0
+	}
+	var x uint64
+	for j := 0; j < bf.bits; j++ {
+		p, m := bit(ptr, f.BitOffset+j)
+		if *p&m != 0 {
+			x |= value_bit(j, bf.bits)
+		}
+	}
+	if is_signed(bf.base.Kind()) && bf.bits < 64 && x&(1<<uint(bf.bits-1)) != 0 {
+		x |= ^uint64(0) << uint(bf.bits)
+	}
+	return int64(x)
+}
+
+// SetBitfield sets the i'th field of the struct or union v, a bitfield,
+// to x.
+// x is truncated to the width of the bitfield.
+// It panics if v's Kind is not Struct or Union or if the field is not a
+// bitfield.
+func (v Value) SetBitfield(i int, x int64) {
+	v.mustBeStructOrUnion()
+	f := v.typ.Field(i)
+	ptr, bf := v.bitfield(f)
+	for j := 0; j < bf.bits; j++ {
+		p, m := bit(ptr, f.BitOffset+j)
+		if uint64(x)&value_bit(j, bf.bits) != 0 {
+			*p |= m
+		} else {
+			*p &^= m
+		}
+	}
+}
+
+// EOF
@@ -0,0 +1,29 @@
+package ffi
+
+// #include <stdint.h>
+// #include "ffi.h"
+import "C"
+
+import (
+	"unsafe"
+)
+
+//export _go_ffi_closure_dispatch
+func _go_ffi_closure_dispatch(cif *C.ffi_cif, ret unsafe.Pointer, args *unsafe.Pointer, data C.uintptr_t) {
+	id := uintptr(data)
+	g_closures.RLock()
+	c, ok := g_closures.m[id]
+	g_closures.RUnlock()
+	if !ok {
+		panic("ffi: call of a freed closure")
+	}
+
+	nargs := int(cif.nargs)
+	var cargs []unsafe.Pointer
+	if nargs > 0 {
+		cargs = unsafe.Slice(args, nargs)
+	}
+	c.call(ret, cargs)
+}
+
+// EOF
@@ -0,0 +1,324 @@
+package ffi
+
+// #include <stdint.h>
+// #include <stdlib.h>
+// #include "ffi.h"
+// typedef void (*_go_ffi_fctptr_t)(void);
+// extern void _go_ffi_closure_dispatch(ffi_cif*, void*, void**, uintptr_t);
+// static void _go_ffi_closure_trampoline(ffi_cif *cif, void *ret, void **args, void *data)
+// {
+//   _go_ffi_closure_dispatch(cif, ret, args, (uintptr_t)data);
+// }
+// static ffi_closure *_go_ffi_closure_alloc(void **code)
+// {
+//   return (ffi_closure*)ffi_closure_alloc(sizeof(ffi_closure), code);
+// }
+// static ffi_status _go_ffi_prep_closure(ffi_closure *c, ffi_cif *cif, uintptr_t id, void *code)
+// {
+//   return ffi_prep_closure_loc(c, cif, _go_ffi_closure_trampoline, (void*)id, code);
+// }
+import "C"
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"unsafe"
+)
+
+// Closure models a ffi closure: a C function pointer which, when
+// invoked from C, calls back into a Go function.
+type Closure struct {
+	c    *C.ffi_closure
+	code unsafe.Pointer
+	cif  *Cif
+	fct  reflect.Value
+	id   uintptr
+}
+
+// the global map of live closures, indexed by their id.
+// C code only ever sees the id (as the closure user-data, an integer cast
+// to a void*) and never a pointer into Go memory.
+var g_closures = struct {
+	sync.RWMutex
+	id uintptr
+	m  map[uintptr]*Closure
+}{m: make(map[uintptr]*Closure)}
+
+var g_value_type = reflect.TypeOf(Value{})
+
+// NewClosure creates a new closure calling the Go function fct with the
+// signature described by cif.
+// fct must be a function taking as many arguments as cif declares, each of
+// them being either a ffi.Value or a Go type the corresponding C argument
+// can be converted to. fct must return nothing if cif returns C_void or
+// exactly one value (a ffi.Value or a convertible Go value) otherwise.
+// Integers are converted to any Go integer or boolean type, floating point
+// numbers to any Go floating point type, and pointers to uintptr or
+// unsafe.Pointer. Other Go types must be compatible with the C types.
+// Go strings returned by fct are copied into the C heap, and handed over to C.
+func NewClosure(cif *Cif, fct interface{}) (*Closure, error) {
+	if cif == nil {
+		return nil, fmt.Errorf("ffi.NewClosure: nil cif")
+	}
+	rv := reflect.ValueOf(fct)
+	if rv.Kind() != reflect.Func || rv.IsNil() {
+		return nil, fmt.Errorf("ffi.NewClosure: expected a func, got [%T]", fct)
+	}
+	rt := rv.Type()
+	if rt.IsVariadic() {
+		return nil, fmt.Errorf("ffi.NewClosure: variadic go functions are not supported")
+	}
+	if rt.NumIn() != len(cif.args) {
+		return nil, fmt.Errorf("ffi.NewClosure: invalid number of arguments. expected '%d', got '%d'",
+			len(cif.args), rt.NumIn())
+	}
+	nout := 1
+	if cif.rtype.Kind() == Void {
+		nout = 0
+	}
+	if rt.NumOut() != nout {
+		return nil, fmt.Errorf("ffi.NewClosure: invalid number of results. expected '%d', got '%d'",
+			nout, rt.NumOut())
+	}
+	for i, typ := range cif.args {
+		if err := check_closure_type(typ, rt.In(i)); err != nil {
+			return nil, fmt.Errorf("ffi.NewClosure: argument #%d: %v", i, err)
+		}
+	}
+	if nout == 1 {
+		if err := check_closure_type(cif.rtype, rt.Out(0)); err != nil {
+			return nil, fmt.Errorf("ffi.NewClosure: result: %v", err)
+		}
+	}
+
+	c := &Closure{
+		cif: cif,
+		fct: rv,
+	}
+	c.c = C._go_ffi_closure_alloc(&c.code)
+	if c.c == nil {
+		return nil, fmt.Errorf("ffi.NewClosure: could not allocate closure")
+	}
+
+	g_closures.Lock()
+	g_closures.id++
+	c.id = g_closures.id
+	g_closures.m[c.id] = c
+	g_closures.Unlock()
+
+	sc := C._go_ffi_prep_closure(c.c, &cif.c, C.uintptr_t(c.id), c.code)
+	if sc != C.FFI_OK {
+		c.Free()
+		return nil, fmt.Errorf("error while preparing closure (%s)",
+			Status(sc))
+	}
+	return c, nil
+}
+
+// FctPtr returns the executable address of the closure, to be handed over
+// to C code expecting a function pointer.
+func (c *Closure) FctPtr() FctPtr {
+	return FctPtr{C._go_ffi_fctptr_t(c.code)}
+}
+
+// Free releases the resources held by the closure.
+// The closure's function pointer must not be called after Free.
+func (c *Closure) Free() {
+	if c.c == nil {
+		return
+	}
+	g_closures.Lock()
+	delete(g_closures.m, c.id)
+	g_closures.Unlock()
+	C.ffi_closure_free(unsafe.Pointer(c.c))
+	c.c = nil
+	c.code = nil
+}
+
+// call invokes the Go function of the closure with the C arguments args,
+// storing its result into ret.
+func (c *Closure) call(ret unsafe.Pointer, args []unsafe.Pointer) {
+	rt := c.fct.Type()
+	in := make([]reflect.Value, len(c.cif.args))
+	for i, typ := range c.cif.args {
+		arg := args[i]
+		if typ.Kind() == Array {
+			// arrays are passed as pointers to their first element
+			arg = *(*unsafe.Pointer)(arg)
+		}
+		in[i] = govalue_from_c(Value{typ, arg}, rt.In(i))
+	}
+	out := c.fct.Call(in)
+	if len(out) == 0 {
+		return
+	}
+	store_closure_result(Value{c.cif.rtype, ret}, out[0])
+}
+
+// int_bits returns the bits of the C integer v, sign-extended if v is signed
+func int_bits(v Value) uint64 {
+	if is_signed(v.Kind()) {
+		return uint64(v.Int())
+	}
+	return v.Uint()
+}
+
+// is_pointer returns whether values of kind k hold a C pointer
+func is_pointer(k Kind) bool {
+	return k == Ptr || k == FuncPtr || k == String
+}
+
+// check_closure_type returns an error if values of the go type rt can not
+// be converted from and to C values of type ct, when passed to or returned
+// from a closure.
+// Integers are converted to any Go integer or boolean type, floating point
+// numbers to any Go floating point type, and pointers to uintptr or
+// unsafe.Pointer. Other Go types must be compatible with ct.
+func check_closure_type(ct Type, rt reflect.Type) (err error) {
+	if rt == g_value_type {
+		return nil
+	}
+	k := ct.Kind()
+	ok := false
+	switch rt.Kind() {
+	case reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		ok = is_signed(k) || is_unsigned(k)
+	case reflect.Uintptr:
+		ok = is_signed(k) || is_unsigned(k) || is_pointer(k)
+	case reflect.UnsafePointer:
+		ok = is_pointer(k)
+	case reflect.Float32, reflect.Float64:
+		ok = k == Float || k == Double || k == LongDouble
+	case reflect.Complex64, reflect.Complex128:
+		ok = k == Complex
+	default:
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("go type [%s] can not be converted to c-type [%s] (%v)", rt, ct.Name(), r)
+			}
+		}()
+		ok = is_compatible(ct, ctype_from_gotype(rt))
+	}
+	if !ok {
+		return fmt.Errorf("go type [%s] can not be converted to c-type [%s]", rt, ct.Name())
+	}
+	return nil
+}
+
+// govalue_from_c converts the C value v into a Go value of type rt,
+// following the rules of check_closure_type.
+func govalue_from_c(v Value, rt reflect.Type) reflect.Value {
+	if rt == g_value_type {
+		return reflect.ValueOf(v)
+	}
+	rv := reflect.New(rt).Elem()
+	switch rt.Kind() {
+	case reflect.Bool:
+		rv.SetBool(v.Bool())
+
+	case reflect.Int,
+		reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		rv.SetInt(int64(int_bits(v)))
+
+	case reflect.Uint,
+		reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		rv.SetUint(int_bits(v))
+
+	case reflect.Float32, reflect.Float64:
+		rv.SetFloat(v.Float())
+
+	case reflect.Complex64, reflect.Complex128:
+		rv.SetComplex(v.Complex())
+
+	case reflect.Uintptr:
+		if is_pointer(v.Kind()) {
+			rv.SetUint(uint64(*(*uintptr)(v.val)))
+			break
+		}
+		rv.SetUint(int_bits(v))
+
+	case reflect.UnsafePointer:
+		rv.SetPointer(*(*unsafe.Pointer)(v.val))
+
+	default:
+		v.get_value(rv)
+	}
+	return rv
+}
+
+// store_closure_result stores the Go value rv into the C return value ret,
+// following the rules of check_closure_type.
+// Integers are truncated to the size of the C type, as in C.
+// As mandated by libffi, integral results smaller than a ffi_arg are
+// widened to a full ffi_arg.
+func store_closure_result(ret Value, rv reflect.Value) {
+	k := ret.typ.Kind()
+	v := New(ret.typ)
+	switch rv.Kind() {
+	case reflect.Bool:
+		v.SetBool(rv.Bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		v.set_bits(uint64(rv.Int()))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		v.set_bits(rv.Uint())
+	case reflect.Uintptr:
+		if is_pointer(k) {
+			*(*uintptr)(v.val) = uintptr(rv.Uint())
+			break
+		}
+		v.set_bits(rv.Uint())
+	case reflect.UnsafePointer:
+		*(*unsafe.Pointer)(v.val) = unsafe.Pointer(rv.Pointer())
+	case reflect.Float32, reflect.Float64:
+		v.SetFloat(rv.Float())
+	case reflect.Complex64, reflect.Complex128:
+		v.SetComplex(rv.Complex())
+	case reflect.String:
+		// strings returned to C are handed over to C
+		*(*unsafe.Pointer)(v.val) = c_string_new(rv.String())
+	default:
+		if rv.Type() != g_value_type {
+			v.set_value(rv)
+			break
+		}
+		x := rv.Interface().(Value)
+		switch {
+		case x.typ != nil && is_compatible(x.typ, ret.typ):
+			memmove(v.val, x.val, ret.typ.Size())
+		case x.typ != nil && (is_signed(x.Kind()) || is_unsigned(x.Kind())) && (is_signed(k) || is_unsigned(k)):
+			v.set_bits(int_bits(x))
+		default:
+			name := "invalid"
+			if x.typ != nil {
+				name = x.typ.Name()
+			}
+			panic("ffi: closure result of type [" + name + "] can not be returned as c-type [" + ret.typ.Name() + "]")
+		}
+	}
+
+	if ret.typ.Size() < unsafe.Sizeof(C.ffi_arg(0)) {
+		switch {
+		case is_signed(k):
+			*(*C.ffi_sarg)(ret.val) = C.ffi_sarg(v.Int())
+			return
+		case is_unsigned(k):
+			*(*C.ffi_arg)(ret.val) = C.ffi_arg(v.Uint())
+			return
+		}
+	}
+	memmove(ret.val, v.val, ret.typ.Size())
+}
+
+// set_bits sets v, a C integer, to the low bits of x
+func (v Value) set_bits(x uint64) {
+	if is_signed(v.Kind()) {
+		v.set_int(int64(x))
+		return
+	}
+	v.set_uint(x)
+}
+
+// EOF
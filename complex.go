@@ -0,0 +1,70 @@
+package ffi
+
+// #include "ffi.h"
+// #ifndef FFI_TARGET_HAS_COMPLEX_TYPE
+// static ffi_type *_go_ffi_complex_float_elems[] = {&ffi_type_float, &ffi_type_float, NULL};
+// static ffi_type *_go_ffi_complex_double_elems[] = {&ffi_type_double, &ffi_type_double, NULL};
+// static ffi_type *_go_ffi_complex_longdouble_elems[] = {&ffi_type_longdouble, &ffi_type_longdouble, NULL};
+// static ffi_type _go_ffi_complex_float = {0, 0, FFI_TYPE_STRUCT, _go_ffi_complex_float_elems};
+// static ffi_type _go_ffi_complex_double = {0, 0, FFI_TYPE_STRUCT, _go_ffi_complex_double_elems};
+// static ffi_type _go_ffi_complex_longdouble = {0, 0, FFI_TYPE_STRUCT, _go_ffi_complex_longdouble_elems};
+// #endif
+// static ffi_type *_go_ffi_type_complex_float(void)
+// {
+// #ifdef FFI_TARGET_HAS_COMPLEX_TYPE
+//   return &ffi_type_complex_float;
+// #else
+//   return &_go_ffi_complex_float;
+// #endif
+// }
+// static ffi_type *_go_ffi_type_complex_double(void)
+// {
+// #ifdef FFI_TARGET_HAS_COMPLEX_TYPE
+//   return &ffi_type_complex_double;
+// #else
+//   return &_go_ffi_complex_double;
+// #endif
+// }
+// static ffi_type *_go_ffi_type_complex_longdouble(void)
+// {
+// #ifdef FFI_TARGET_HAS_COMPLEX_TYPE
+//   return &ffi_type_complex_longdouble;
+// #else
+//   return &_go_ffi_complex_longdouble;
+// #endif
+// }
+import "C"
+
+import (
+	"reflect"
+	"unsafe"
+)
+
+// cffi_complex describes a C complex type.
+// When libffi has no support for complex types on the target platform,
+// a complex type is modeled as a struct of its real and imaginary parts.
+type cffi_complex struct {
+	cffi_type
+	elem Type // type of the real and imaginary parts
+}
+
+func (t *cffi_complex) Kind() Kind {
+	return Complex
+}
+
+var (
+	C_complex_float      Type = &cffi_complex{cffi_type{"float _Complex", C._go_ffi_type_complex_float(), reflect.TypeOf(complex64(0))}, C_float}
+	C_complex_double     Type = &cffi_complex{cffi_type{"double _Complex", C._go_ffi_type_complex_double(), reflect.TypeOf(complex128(0))}, C_double}
+	C_complex_longdouble Type = &cffi_complex{cffi_type{"long double _Complex", C._go_ffi_type_complex_longdouble(), nil}, C_longdouble}
+)
+
+// complex_parts returns pointers to the real and imaginary parts of the
+// complex value v.
+func (v Value) complex_parts() (Value, Value) {
+	elem := v.typ.(*cffi_complex).elem
+	re := Value{elem, v.val}
+	im := Value{elem, unsafe.Pointer(uintptr(v.val) + elem.Size())}
+	return re, im
+}
+
+// EOF
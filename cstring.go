@@ -0,0 +1,142 @@
+package ffi
+
+// #include <stdlib.h>
+// #include <string.h>
+// #include "ffi.h"
+import "C"
+
+import (
+	"reflect"
+	"unsafe"
+)
+
+// StringMode describes who owns the memory of the C strings exchanged
+// through a string type.
+type StringMode int
+
+const (
+	// StringBorrowed strings are owned by the C side and never freed by ffi.
+	// Go strings passed as arguments are copied into the C heap for the
+	// duration of the call only.
+	StringBorrowed StringMode = iota
+
+	// StringCopied strings are copied into the C heap and handed over to
+	// the C side, which becomes responsible for freeing them.
+	// Strings returned by C are not freed.
+	StringCopied
+
+	// StringCallerFrees strings returned by C are copied into Go memory and
+	// then released with free(3).
+	// Go strings passed as arguments are copied into the C heap for the
+	// duration of the call only.
+	StringCallerFrees
+)
+
+func (m StringMode) String() string {
+	switch m {
+	case StringBorrowed:
+		return "StringBorrowed"
+	case StringCopied:
+		return "StringCopied"
+	case StringCallerFrees:
+		return "StringCallerFrees"
+	}
+	panic("unreachable")
+}
+
+// cffi_string describes a C string (char*).
+type cffi_string struct {
+	cffi_type
+	mode StringMode
+}
+
+func (t *cffi_string) Kind() Kind {
+	return String
+}
+
+var g_string_type = reflect.TypeOf("")
+
+var (
+	C_string Type = &cffi_string{cffi_type{"char*", &C.ffi_type_pointer, g_string_type}, StringBorrowed}
+
+	c_string_copied = &cffi_string{cffi_type{"char* /*copied*/", &C.ffi_type_pointer, g_string_type}, StringCopied}
+	c_string_freed  = &cffi_string{cffi_type{"char* /*caller frees*/", &C.ffi_type_pointer, g_string_type}, StringCallerFrees}
+)
+
+// NewStringType returns the C string (char*) type with the given memory
+// ownership mode.
+// NewStringType(StringBorrowed) is C_string.
+func NewStringType(mode StringMode) Type {
+	switch mode {
+	case StringBorrowed:
+		return C_string
+	case StringCopied:
+		return c_string_copied
+	case StringCallerFrees:
+		return c_string_freed
+	}
+	panic("ffi.NewStringType: invalid string mode")
+}
+
+// string_mode returns the memory ownership mode of the string type t
+func string_mode(t Type) StringMode {
+	if t, ok := t.(*cffi_string); ok {
+		return t.mode
+	}
+	return StringBorrowed
+}
+
+// c_string_new returns a copy of s, allocated on the C heap.
+func c_string_new(s string) unsafe.Pointer {
+	return unsafe.Pointer(C.CString(s))
+}
+
+// c_string_free releases the C string p.
+func c_string_free(p unsafe.Pointer) {
+	C.free(p)
+}
+
+// c_string_go returns the Go string corresponding to the C string p.
+// It returns "" if p is NULL.
+func c_string_go(p unsafe.Pointer) string {
+	if p == nil {
+		return ""
+	}
+	return C.GoString((*C.char)(p))
+}
+
+// go_c_string returns a copy of the C string p, allocated in Go memory.
+// The returned pointer is stored in GC-visible memory, so the copy lives
+// as long as the returned storage.
+func go_c_string(p unsafe.Pointer) unsafe.Pointer {
+	n := int(C.strlen((*C.char)(p)))
+	buf := make([]byte, n+1)
+	copy(buf, unsafe.Slice((*byte)(p), n))
+	ptr := new(unsafe.Pointer)
+	*ptr = unsafe.Pointer(&buf[0])
+	return unsafe.Pointer(ptr)
+}
+
+// chars returns the string held by v, an array of bytes.
+// The string ends at the first NUL byte, or at the end of the array.
+func (v Value) chars() string {
+	buf := v.Buffer()
+	for i, c := range buf {
+		if c == 0 {
+			return string(buf[:i])
+		}
+	}
+	return string(buf)
+}
+
+// set_chars stores s into v, an array of bytes, as does strncpy(3):
+// s is truncated to the length of the array, and padded with NUL bytes.
+func (v Value) set_chars(s string) {
+	buf := v.Buffer()
+	n := copy(buf, s)
+	for i := n; i < len(buf); i++ {
+		buf[i] = 0
+	}
+}
+
+// EOF
@@ -43,12 +43,12 @@ func (dec *Decoder) decode_value(v reflect.Value) (err error) {
 		v = v.Elem()
 	}
 
-	v.Set(dec.cval.GoValue())
 	defer func() {
 		if r := recover(); r != nil {
 			err = fmt.Errorf("ffi.Decoder: %v", r)
 		}
 	}()
+	dec.cval.get_value(v)
 	return
 }
 
@@ -30,12 +30,12 @@ func (enc *Encoder) Encode(v interface{}) error {
 }
 
 func (enc *Encoder) encode_value(v reflect.Value) (err error) {
-	enc.cval.set_value(v)
 	defer func() {
 		if r := recover(); r != nil {
 			err = fmt.Errorf("ffi.Encoder: %v", r)
 		}
 	}()
+	enc.cval.set_value(v)
 	return err
 }
 
@@ -0,0 +1,156 @@
+package ffi
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+)
+
+// cffi_enum describes a C enum.
+// It shares the ffi_type of its underlying integer type, and thus behaves
+// as that integer type.
+type cffi_enum struct {
+	cffi_type
+	base   Type
+	values map[string]int64
+	names  map[int64]string
+	reg    *TypeRegistry // registry the enum is declared in
+
+	// associated is true once the enum has been associated to a go type
+	associated bool
+}
+
+// NewEnumType creates a new ffi_type describing a C enum with the given
+// underlying integer type and named constants.
+// Values of an enum type only hold one of its constants: SetInt and
+// SetUint panic on any other value.
+func NewEnumType(name string, underlying Type, values map[string]int64) (Type, error) {
+	return g_types.NewEnumType(name, underlying, values)
+}
+
+// NewEnumType creates a new ffi_type describing a C enum, declared in r.
+func (r *TypeRegistry) NewEnumType(name string, underlying Type, values map[string]int64) (Type, error) {
+	if k := underlying.Kind(); !is_signed(k) && !is_unsigned(k) {
+		return nil, fmt.Errorf("ffi.NewEnumType: invalid underlying type [%s]", underlying.Name())
+	}
+	if name == "" {
+		// anonymous type...
+		// generate some id.
+		name = fmt.Sprintf("_ffi_anon_type_%d", <-g_id_ch)
+	}
+	if err := r.check_name(name); err != nil {
+		return nil, fmt.Errorf("ffi.NewEnumType: %v", err)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if t := r.type_by_name(name); t != nil {
+		// check the definitions are the same
+		et, ok := t.(*cffi_enum)
+		if !ok || et.base != underlying || len(et.values) != len(values) {
+			return nil, fmt.Errorf("ffi.NewEnumType: inconsistent re-declaration of [%s]", name)
+		}
+		for n, x := range values {
+			if y, ok := et.values[n]; !ok || x != y {
+				return nil, fmt.Errorf("ffi.NewEnumType: inconsistent re-declaration of [%s] (constant [%s] mismatch)", name, n)
+			}
+		}
+		return t, nil
+	}
+
+	t := &cffi_enum{
+		cffi_type: cffi_type{name, underlying.cptr(), underlying.GoType()},
+		base:      underlying,
+		values:    make(map[string]int64, len(values)),
+		names:     make(map[int64]string, len(values)),
+		reg:       r,
+	}
+	for _, n := range enum_names(values) {
+		x := values[n]
+		if !t.fits(x) {
+			return nil, fmt.Errorf("ffi.NewEnumType: constant [%s] (%d) overflows [%s]", n, x, underlying.Name())
+		}
+		t.values[n] = x
+		if _, dup := t.names[x]; !dup {
+			t.names[x] = n
+		}
+	}
+	r.register(t)
+	return t, nil
+}
+
+// enum_names returns the names of the constants, in a deterministic order
+func enum_names(values map[string]int64) []string {
+	names := make([]string, 0, len(values))
+	for n := range values {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// fits returns whether x is representable by the underlying type of t
+func (t *cffi_enum) fits(x int64) bool {
+	bits := 8 * t.Size()
+	if is_unsigned(t.Kind()) {
+		return x >= 0 && (bits >= 64 || uint64(x) < 1<<bits)
+	}
+	return bits >= 64 || (x >= -1<<(bits-1) && x < 1<<(bits-1))
+}
+
+// has returns whether x is one of the constants of t
+func (t *cffi_enum) has(x int64) bool {
+	_, ok := t.names[x]
+	return ok
+}
+
+// check panics if x is not one of the constants of t
+func (t *cffi_enum) check(method string, x int64) {
+	if !t.has(x) {
+		panic(fmt.Sprintf("ffi: %s: invalid value %d for enum [%s]", method, x, t.Name()))
+	}
+}
+
+// check_enum_value returns an error if typ is an enum and x is not one of
+// its constants
+func check_enum_value(typ Type, x int64) error {
+	if et, ok := typ.(*cffi_enum); ok && !et.has(x) {
+		return fmt.Errorf("invalid value %d for enum [%s]", x, typ.Name())
+	}
+	return nil
+}
+
+// name returns the name of the constant x
+func (t *cffi_enum) name(x int64) string {
+	if n, ok := t.names[x]; ok {
+		return n
+	}
+	return t.Name() + "(" + strconv.FormatInt(x, 10) + ")"
+}
+
+// associate links the enum to the named go integer type rt
+func (t *cffi_enum) associate(rt reflect.Type) error {
+	g_gotypes.Lock()
+	defer g_gotypes.Unlock()
+	if t.associated {
+		if t.rt != rt {
+			return fmt.Errorf("ffi.Associate: ffi.Type [%s] already associated to reflect.Type [%s]", t.Name(), t.rt.Name())
+		}
+		return nil
+	}
+	switch rt.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+	default:
+		return fmt.Errorf("ffi.Associate: can not associate enum [%s] to non-integer reflect.Type [%s]", t.Name(), rt.Name())
+	}
+	if rt.Size() != t.Size() {
+		return fmt.Errorf("ffi.Associate: can not associate enum [%s] to reflect.Type [%s] (size mismatch)", t.Name(), rt.Name())
+	}
+	t.rt = rt
+	t.associated = true
+	g_assoc[rt] = t
+	return nil
+}
+
+// EOF
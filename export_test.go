@@ -0,0 +1,13 @@
+package ffi
+
+// CPlatformType returns the size and signedness of the builtin c integer
+// type n, as derived from the c compiler by cgo.
+func CPlatformType(n string) (uintptr, bool) {
+	t := TypeByName(n)
+	if t == nil {
+		panic("ffi.CPlatformType: no such type [" + n + "]")
+	}
+	return t.Size(), is_signed(t.Kind())
+}
+
+// EOF
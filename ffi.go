@@ -1,14 +1,26 @@
 package ffi
 
 // #include <stdlib.h>
+// #include <errno.h>
 // #include "ffi.h"
 // typedef void (*_go_ffi_fctptr_t)(void);
+// static int _go_ffi_call_errno(ffi_cif *cif, _go_ffi_fctptr_t fn, void *rvalue, void **avalue)
+// {
+//   errno = 0;
+//   ffi_call(cif, fn, rvalue, avalue);
+//   return errno;
+// }
 import "C"
 
 import (
 	"fmt"
+	"math"
+	"math/big"
 	"reflect"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"unsafe"
 
 	"github.com/sbinet/go-ffi/dl"
@@ -76,13 +88,16 @@ type FctPtr struct {
 
 // NewCif creates a new ffi call interface object
 func NewCif(abi Abi, rtype Type, args []Type) (*Cif, error) {
+	if err := check_cif_types(rtype, args); err != nil {
+		return nil, err
+	}
 	cif := &Cif{}
 	c_nargs := C.uint(len(args))
 	var c_args **C.ffi_type = nil
 	if len(args) > 0 {
 		var cargs = make([]*C.ffi_type, len(args))
 		for i, _ := range args {
-			cargs[i] = args[i].cptr()
+			cargs[i] = cif_arg_type(args[i])
 		}
 		c_args = &cargs[0]
 	}
@@ -96,130 +111,609 @@ func NewCif(abi Abi, rtype Type, args []Type) (*Cif, error) {
 	return cif, nil
 }
 
-// Call invokes the cif with the provided function pointer and arguments
-func (cif *Cif) Call(fct FctPtr, args ...interface{}) (reflect.Value, error) {
+// layout_type lets libffi compute the size and alignment of the type t,
+// if they are not set yet.
+func layout_type(t Type) error {
+	var cif C.ffi_cif
+	sc := C.ffi_prep_cif(&cif, C.ffi_abi(DefaultAbi), 0, t.cptr(), nil)
+	if sc != C.FFI_OK {
+		return fmt.Errorf("error while preparing cif (%s)",
+			Status(sc))
+	}
+	return nil
+}
+
+// check_byvalue returns an error if values of type t can not be passed
+// by value through libffi.
+func check_byvalue(t Type) error {
+	switch t.Kind() {
+	case Struct, Union:
+		if is_incomplete(t) {
+			return fmt.Errorf("ffi: type [%s] is incomplete", t.Name())
+		}
+		if is_flexible(t) {
+			return fmt.Errorf("ffi: type [%s] has a flexible array member", t.Name())
+		}
+		if t.Size() == 0 {
+			return fmt.Errorf("ffi: type [%s] has a zero size", t.Name())
+		}
+		if ut, ok := t.(*cffi_union); ok && ut.is_irregular() {
+			return fmt.Errorf("ffi: type [%s] has a layout libffi can not pass by value", t.Name())
+		}
+		if st, ok := t.(*cffi_struct); ok && st.is_irregular() {
+			return fmt.Errorf("ffi: type [%s] has a layout libffi can not pass by value", t.Name())
+		}
+		for i := 0; i < t.NumField(); i++ {
+			if err := check_byvalue(t.Field(i).Type); err != nil {
+				return err
+			}
+		}
+	case Array:
+		return check_byvalue(t.Elem())
+	}
+	return nil
+}
+
+// check_cif_types returns an error if one of the types of a cif can not
+// be passed by value through libffi.
+// Array arguments decay to pointers.
+func check_cif_types(rtype Type, args []Type) error {
+	if rtype.Kind() == Array {
+		return fmt.Errorf("ffi: functions can not return arrays (type [%s])", rtype.Name())
+	}
+	if err := check_byvalue(rtype); err != nil {
+		return err
+	}
+	for _, arg := range args {
+		if arg.Kind() == Array {
+			continue
+		}
+		if err := check_byvalue(arg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cif_arg_type returns the ffi_type libffi passes values of type t as.
+// Arrays decay to pointers to their first element.
+func cif_arg_type(t Type) *C.ffi_type {
+	if t.Kind() == Array {
+		return C_pointer.cptr()
+	}
+	return t.cptr()
+}
+
+// NewCifVar creates a new ffi call interface object for a variadic function.
+// args holds the types of all the arguments of a given call: the nfixed
+// fixed arguments followed by the variadic ones.
+func NewCifVar(abi Abi, nfixed int, rtype Type, args []Type) (*Cif, error) {
+	if nfixed < 0 || nfixed > len(args) {
+		return nil, fmt.Errorf("ffi.NewCifVar: invalid number of fixed arguments (%d)", nfixed)
+	}
+	if err := check_cif_types(rtype, args); err != nil {
+		return nil, err
+	}
+	cif := &Cif{}
+	c_nargs := C.uint(len(args))
+	var c_args **C.ffi_type = nil
+	if len(args) > 0 {
+		var cargs = make([]*C.ffi_type, len(args))
+		for i, _ := range args {
+			cargs[i] = cif_arg_type(args[i])
+		}
+		c_args = &cargs[0]
+	}
+	sc := C.ffi_prep_cif_var(&cif.c, C.ffi_abi(abi), C.uint(nfixed), c_nargs, rtype.cptr(), c_args)
+	if sc != C.FFI_OK {
+		return nil, fmt.Errorf("error while preparing cif (%s)",
+			Status(sc))
+	}
+	cif.rtype = rtype
+	cif.args = args
+	return cif, nil
+}
+
+// Call invokes the cif with the provided function pointer and arguments.
+// Struct arguments may be given as ffi.Values or Go structs.
+// Union arguments must be given as ffi.Values.
+// Array arguments decay to pointers to their first element, as in C: they
+// may be given as ffi.Values or Go arrays, which are copied.
+// Function pointer arguments may be given as FctPtrs, *Closures or
+// ffi.Values.
+// The result is returned as a Value of the cif's return type.
+// Call returns an *ArgumentError if an argument can not be converted to
+// the corresponding C type declared by the cif.
+func (cif *Cif) Call(fct FctPtr, args ...interface{}) (Value, error) {
+	out, _, err := cif.call(fct, false, args)
+	return out, err
+}
+
+// CallErrno invokes the cif like Call does, but also returns the value of
+// errno as set by the C function.
+// errno is cleared right before the call and captured right after it,
+// on the same thread.
+func (cif *Cif) CallErrno(fct FctPtr, args ...interface{}) (Value, syscall.Errno, error) {
+	return cif.call(fct, true, args)
+}
+
+func (cif *Cif) call(fct FctPtr, with_errno bool, args []interface{}) (Value, syscall.Errno, error) {
 	nargs := len(args)
 	if nargs != int(cif.c.nargs) {
-		return reflect.New(reflect.TypeOf(0)), fmt.Errorf("ffi: invalid number of arguments. expected '%d', got '%s'.",
+		return Value{}, 0, fmt.Errorf("ffi: invalid number of arguments. expected '%d', got '%d'.",
 			int(cif.c.nargs), nargs)
 	}
 	var c_args *unsafe.Pointer = nil
 	if nargs > 0 {
 		cargs := make([]unsafe.Pointer, nargs)
+		cstrs := make([]*C.char, 0)
+		defer func() {
+			for _, cstr := range cstrs {
+				C.free(unsafe.Pointer(cstr))
+			}
+		}()
 		for i, _ := range args {
-			var carg unsafe.Pointer
 			//fmt.Printf("[%d]: (%v)\n", i, args[i])
-			t := reflect.TypeOf(args[i])
-			rv := reflect.ValueOf(args[i])
-			switch t.Kind() {
-			case reflect.String:
-				cstr := C.CString(args[i].(string))
-				defer C.free(unsafe.Pointer(cstr))
-				carg = unsafe.Pointer(&cstr)
-			case reflect.Ptr:
-				carg = unsafe.Pointer(rv.Elem().UnsafeAddr())
-			case reflect.Float32:
-				vv := args[i].(float32)
-				rv = reflect.ValueOf(&vv)
-				carg = unsafe.Pointer(rv.Elem().UnsafeAddr())
-			case reflect.Float64:
-				vv := args[i].(float64)
-				rv = reflect.ValueOf(&vv)
-				carg = unsafe.Pointer(rv.Elem().UnsafeAddr())
-			case reflect.Int:
-				vv := args[i].(int)
-				rv = reflect.ValueOf(&vv)
-				carg = unsafe.Pointer(rv.Elem().UnsafeAddr())
-			case reflect.Int8:
-				vv := args[i].(int8)
-				rv = reflect.ValueOf(&vv)
-				carg = unsafe.Pointer(rv.Elem().UnsafeAddr())
-			case reflect.Int16:
-				vv := args[i].(int16)
-				rv = reflect.ValueOf(&vv)
-				carg = unsafe.Pointer(rv.Elem().UnsafeAddr())
-			case reflect.Int32:
-				vv := args[i].(int32)
-				rv = reflect.ValueOf(&vv)
-				carg = unsafe.Pointer(rv.Elem().UnsafeAddr())
-			case reflect.Int64:
-				vv := args[i].(int64)
-				rv = reflect.ValueOf(&vv)
-				carg = unsafe.Pointer(rv.Elem().UnsafeAddr())
-			case reflect.Uint:
-				vv := args[i].(uint)
-				rv = reflect.ValueOf(&vv)
-				carg = unsafe.Pointer(rv.Elem().UnsafeAddr())
-			case reflect.Uint8:
-				vv := args[i].(uint8)
-				rv = reflect.ValueOf(&vv)
-				carg = unsafe.Pointer(rv.Elem().UnsafeAddr())
-			case reflect.Uint16:
-				vv := args[i].(uint16)
-				rv = reflect.ValueOf(&vv)
-				carg = unsafe.Pointer(rv.Elem().UnsafeAddr())
-			case reflect.Uint32:
-				vv := args[i].(uint32)
-				rv = reflect.ValueOf(&vv)
-				carg = unsafe.Pointer(rv.Elem().UnsafeAddr())
-			case reflect.Uint64:
-				vv := args[i].(uint64)
-				rv = reflect.ValueOf(&vv)
-				carg = unsafe.Pointer(rv.Elem().UnsafeAddr())
+			carg, err := cif.arg_ptr(i, args[i], &cstrs)
+			if err != nil {
+				return Value{}, 0, err
 			}
 			cargs[i] = carg
 		}
 		c_args = &cargs[0]
 	}
-	out := reflect.New(rtype_from_ffi(cif.rtype.cptr()))
-	var c_out unsafe.Pointer = unsafe.Pointer(out.Elem().UnsafeAddr())
+
+	c_out := cif.new_result()
+	var errno syscall.Errno
 	//println("...ffi_call...")
-	C.ffi_call(&cif.c, fct.c, c_out, c_args)
-	//fmt.Printf("...ffi_call...[done] [%v]\n",out.Elem())
-	return out.Elem(), nil
-}
-
-type go_void struct{}
-
-func rtype_from_ffi(t *C.ffi_type) reflect.Type {
-	switch t {
-	case &C.ffi_type_void:
-		return reflect.TypeOf(go_void{})
-	case &C.ffi_type_pointer:
-		return reflect.TypeOf(uintptr(0))
-	case &C.ffi_type_uint:
-		return reflect.TypeOf(uint(0))
-	case &C.ffi_type_sint:
-		return reflect.TypeOf(int(0))
-	case &C.ffi_type_uint8:
-		return reflect.TypeOf(uint8(0))
-	case &C.ffi_type_sint8:
-		return reflect.TypeOf(int8(0))
-	case &C.ffi_type_uint16:
-		return reflect.TypeOf(uint16(0))
-	case &C.ffi_type_sint16:
-		return reflect.TypeOf(int16(0))
-	case &C.ffi_type_uint32:
-		return reflect.TypeOf(uint32(0))
-	case &C.ffi_type_sint32:
-		return reflect.TypeOf(int32(0))
-	case &C.ffi_type_uint64:
-		return reflect.TypeOf(uint64(0))
-	case &C.ffi_type_sint64:
-		return reflect.TypeOf(int64(0))
-	case &C.ffi_type_ulong:
-		return reflect.TypeOf(uint64(0))
-	case &C.ffi_type_slong:
-		return reflect.TypeOf(int64(0))
-	case &C.ffi_type_float:
-		return reflect.TypeOf(float32(0))
-	case &C.ffi_type_double:
-		return reflect.TypeOf(float64(0))
-	case &C.ffi_type_longdouble:
-		// FIXME!!
-		return reflect.TypeOf(complex128(0))
+	if with_errno {
+		errno = syscall.Errno(C._go_ffi_call_errno(&cif.c, fct.c, c_out, c_args))
+	} else {
+		C.ffi_call(&cif.c, fct.c, c_out, c_args)
 	}
-	panic("unreachable")
+	//println("...ffi_call...[done]")
+	return cif.result(c_out), errno, nil
+}
+
+// new_result allocates the storage for the return value of the cif.
+// libffi writes integral results smaller than a ffi_arg as a full ffi_arg,
+// so the storage is always at least that large.
+func (cif *Cif) new_result() unsafe.Pointer {
+	sz := cif.rtype.Size()
+	if sz < unsafe.Sizeof(C.ffi_arg(0)) {
+		sz = unsafe.Sizeof(C.ffi_arg(0))
+	}
+	buf := make([]byte, int(sz))
+	return unsafe.Pointer(&buf[0])
+}
+
+// result returns the return value stored at ptr by libffi as a Value of
+// the cif's return type, narrowing integral results smaller than a ffi_arg.
+// It returns an invalid Value of type C_void if the cif returns C_void.
+func (cif *Cif) result(ptr unsafe.Pointer) Value {
+	typ := cif.rtype
+	small := typ.Size() < unsafe.Sizeof(C.ffi_arg(0))
+	switch k := typ.Kind(); {
+	case k == Void:
+		return Value{typ: typ}
+	case k == String && string_mode(typ) == StringCallerFrees:
+		cstr := *(*unsafe.Pointer)(ptr)
+		if cstr == nil {
+			return Value{typ, ptr}
+		}
+		defer c_string_free(cstr)
+		return Value{typ, go_c_string(cstr)}
+	case small && is_signed(k):
+		v := New(typ)
+		v.set_int(int64(*(*C.ffi_sarg)(ptr)))
+		return v
+	case small && is_unsigned(k):
+		v := New(typ)
+		v.set_uint(uint64(*(*C.ffi_arg)(ptr)))
+		return v
+	}
+	return Value{typ, ptr}
+}
+
+// An ArgumentError occurs when a Go value can not be passed as an argument
+// of the C type declared by a Cif.
+type ArgumentError struct {
+	Index  int          // index of the argument
+	CType  Type         // expected C type
+	GoType reflect.Type // given Go type
+	Err    error        // conversion error, if any
+}
+
+func (e *ArgumentError) Error() string {
+	gotype := "nil"
+	if e.GoType != nil {
+		gotype = e.GoType.String()
+	}
+	msg := fmt.Sprintf("ffi: argument #%d: can not use go-value of type [%s] as c-type [%s]",
+		e.Index, gotype, e.CType.Name())
+	if e.Err != nil {
+		msg += " (" + e.Err.Error() + ")"
+	}
+	return msg
+}
+
+// arg_ptr returns a pointer to the C representation of the i-th argument.
+// C strings allocated on the way are appended to cstrs.
+// Go numeric values are converted to the C type declared by the cif.
+// Go pointers are passed as the value they point at.
+func (cif *Cif) arg_ptr(i int, arg interface{}, cstrs *[]*C.char) (unsafe.Pointer, error) {
+	typ := cif.args[i]
+	arg_err := &ArgumentError{Index: i, CType: typ, GoType: reflect.TypeOf(arg)}
+
+	switch typ.Kind() {
+	case Struct:
+		v, err := struct_arg(typ, arg)
+		if err != nil {
+			arg_err.Err = err
+			return nil, arg_err
+		}
+		return v.val, nil
+	case Union:
+		v, ok := arg.(Value)
+		if !ok || !is_compatible(typ, v.typ) {
+			return nil, arg_err
+		}
+		return v.val, nil
+	case Array:
+		v, err := array_arg(typ, arg)
+		if err != nil {
+			return nil, arg_err
+		}
+		// pass the address of the first element
+		ptr := v.val
+		return unsafe.Pointer(&ptr), nil
+	case LongDouble:
+		switch a := arg.(type) {
+		case CLongDouble:
+			return unsafe.Pointer(&a), nil
+		case *big.Float:
+			if a == nil {
+				return nil, arg_err
+			}
+			ld := CLongDoubleFromBig(a)
+			return unsafe.Pointer(&ld), nil
+		}
+	case String:
+		switch a := arg.(type) {
+		case nil:
+			var ptr unsafe.Pointer
+			return unsafe.Pointer(&ptr), nil
+		case string:
+			cstr := C.CString(a)
+			if string_mode(typ) != StringCopied {
+				*cstrs = append(*cstrs, cstr)
+			}
+			return unsafe.Pointer(&cstr), nil
+		case Value:
+			if a.Kind() != String {
+				return nil, arg_err
+			}
+			return a.val, nil
+		}
+		return nil, arg_err
+	case FuncPtr:
+		switch a := arg.(type) {
+		case nil:
+			var ptr unsafe.Pointer
+			return unsafe.Pointer(&ptr), nil
+		case FctPtr:
+			return unsafe.Pointer(&a.c), nil
+		case *Closure:
+			fct := a.FctPtr()
+			return unsafe.Pointer(&fct.c), nil
+		case Value:
+			if a.Kind() != FuncPtr || !is_compatible(typ, a.Type()) {
+				return nil, arg_err
+			}
+			return a.val, nil
+		}
+		return nil, arg_err
+	case Ptr:
+		switch a := arg.(type) {
+		case nil:
+			var ptr unsafe.Pointer
+			return unsafe.Pointer(&ptr), nil
+		case FctPtr:
+			return unsafe.Pointer(&a.c), nil
+		case string:
+			cstr := C.CString(a)
+			*cstrs = append(*cstrs, cstr)
+			return unsafe.Pointer(&cstr), nil
+		case Value:
+			if a.Kind() != Ptr || !is_compatible(typ, a.Type()) {
+				return nil, arg_err
+			}
+			return a.val, nil
+		}
+	}
+
+	if a, ok := arg.(Value); ok {
+		// numeric values are passed as they are held by the Value
+		if !is_numeric(typ.Kind()) || !is_compatible(typ, a.Type()) {
+			return nil, arg_err
+		}
+		if _, ok := typ.(*cffi_enum); ok && a.Type() != typ {
+			// values of other integer types must hold a constant of the enum
+			x := int64(0)
+			if is_unsigned(a.Kind()) {
+				x = int64(a.Uint())
+			} else {
+				x = a.Int()
+			}
+			if err := check_enum_value(typ, x); err != nil {
+				arg_err.Err = err
+				return nil, arg_err
+			}
+		}
+		return a.val, nil
+	}
+
+	if arg == nil {
+		return nil, arg_err
+	}
+	rv := reflect.ValueOf(arg)
+	if rv.Kind() == reflect.Ptr {
+		if rv.IsNil() {
+			return nil, arg_err
+		}
+		rv = rv.Elem()
+	} else {
+		// make an addressable copy
+		v := reflect.New(rv.Type()).Elem()
+		v.Set(rv)
+		rv = v
+	}
+
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64, reflect.Complex64, reflect.Complex128:
+		v, err := convert_arg(typ, rv)
+		if err != nil {
+			arg_err.Err = err
+			return nil, arg_err
+		}
+		return v.val, nil
+	case reflect.Bool:
+		// C booleans are integers
+		if k := typ.Kind(); !is_signed(k) && !is_unsigned(k) {
+			return nil, arg_err
+		}
+		x := int64(0)
+		if rv.Bool() {
+			x = 1
+		}
+		if err := check_enum_value(typ, x); err != nil {
+			arg_err.Err = err
+			return nil, arg_err
+		}
+		v := New(typ)
+		v.SetBool(rv.Bool())
+		return v.val, nil
+	case reflect.Uintptr:
+		if k := typ.Kind(); is_signed(k) || is_unsigned(k) {
+			v, err := convert_arg(typ, rv)
+			if err != nil {
+				arg_err.Err = err
+				return nil, arg_err
+			}
+			return v.val, nil
+		}
+		if typ.Kind() != Ptr {
+			return nil, arg_err
+		}
+	case reflect.UnsafePointer, reflect.Ptr:
+		if typ.Kind() != Ptr {
+			return nil, arg_err
+		}
+	default:
+		return nil, arg_err
+	}
+	return unsafe.Pointer(rv.UnsafeAddr()), nil
+}
+
+// is_signed returns whether k is the kind of a C signed integer type
+func is_signed(k Kind) bool {
+	switch k {
+	case Int, Int8, Int16, Int32, Int64:
+		return true
+	}
+	return false
+}
+
+// is_unsigned returns whether k is the kind of a C unsigned integer type
+func is_unsigned(k Kind) bool {
+	switch k {
+	case Uint8, Uint16, Uint32, Uint64:
+		return true
+	}
+	return false
+}
+
+// is_numeric returns whether k is the kind of a C integer, floating point
+// or complex type
+func is_numeric(k Kind) bool {
+	switch k {
+	case Float, Double, LongDouble, Complex:
+		return true
+	}
+	return is_signed(k) || is_unsigned(k)
+}
+
+// convert_arg converts the Go numeric value rv into a new C value of
+// type typ, checking for overflows.
+// Integers may be converted to floating point types and real numbers to
+// complex types, but not the other way around.
+func convert_arg(typ Type, rv reflect.Value) (Value, error) {
+	overflow := func() (Value, error) {
+		return Value{}, fmt.Errorf("value [%v] overflows c-type [%s]", rv.Interface(), typ.Name())
+	}
+	bits := 8 * typ.Size()
+	v := New(typ)
+	switch rv.Kind() {
+	case reflect.Complex64, reflect.Complex128:
+		if typ.Kind() != Complex {
+			return Value{}, fmt.Errorf("can not convert complex value to c-type [%s]", typ.Name())
+		}
+	}
+	switch k := typ.Kind(); {
+	case is_signed(k):
+		var x int64
+		switch rv.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			x = rv.Int()
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+			if rv.Uint() > math.MaxInt64 {
+				return overflow()
+			}
+			x = int64(rv.Uint())
+		default:
+			return Value{}, fmt.Errorf("can not convert floating point value to c-type [%s]", typ.Name())
+		}
+		if bits < 64 && (x < -1<<(bits-1) || x > 1<<(bits-1)-1) {
+			return overflow()
+		}
+		if err := check_enum_value(typ, x); err != nil {
+			return Value{}, err
+		}
+		v.SetInt(x)
+
+	case is_unsigned(k):
+		var x uint64
+		switch rv.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			if rv.Int() < 0 {
+				return overflow()
+			}
+			x = uint64(rv.Int())
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+			x = rv.Uint()
+		default:
+			return Value{}, fmt.Errorf("can not convert floating point value to c-type [%s]", typ.Name())
+		}
+		if bits < 64 && x > 1<<bits-1 {
+			return overflow()
+		}
+		if err := check_enum_value(typ, int64(x)); err != nil {
+			return Value{}, err
+		}
+		v.SetUint(x)
+
+	case k == LongDouble:
+		switch rv.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			v.SetCLongDouble(CLongDoubleFromBig(new(big.Float).SetInt64(rv.Int())))
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			v.SetCLongDouble(CLongDoubleFromBig(new(big.Float).SetUint64(rv.Uint())))
+		default:
+			v.SetFloat(rv.Float())
+		}
+
+	case k == Float, k == Double:
+		var x float64
+		switch rv.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			x = float64(rv.Int())
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			x = float64(rv.Uint())
+		default:
+			x = rv.Float()
+		}
+		if k == Float && !math.IsInf(x, 0) && math.Abs(x) > math.MaxFloat32 {
+			return overflow()
+		}
+		v.SetFloat(x)
+
+	case k == Complex:
+		var x complex128
+		switch rv.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			x = complex(float64(rv.Int()), 0)
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			x = complex(float64(rv.Uint()), 0)
+		case reflect.Float32, reflect.Float64:
+			x = complex(rv.Float(), 0)
+		default:
+			x = rv.Complex()
+		}
+		if typ.(*cffi_complex).elem.Kind() == Float {
+			for _, f := range []float64{real(x), imag(x)} {
+				if !math.IsInf(f, 0) && math.Abs(f) > math.MaxFloat32 {
+					return overflow()
+				}
+			}
+		}
+		v.SetComplex(x)
+
+	default:
+		return Value{}, fmt.Errorf("can not convert numeric value to c-type [%s]", typ.Name())
+	}
+	return v, nil
+}
+
+// struct_arg returns the ffi.Value holding the struct argument arg of type typ.
+// arg may be a ffi.Value, a Go struct or a pointer to a Go struct.
+func struct_arg(typ Type, arg interface{}) (Value, error) {
+	if v, ok := arg.(Value); ok {
+		if !is_compatible(typ, v.typ) {
+			return Value{}, fmt.Errorf("incompatible ffi.Value of type [%s]", v.typ.Name())
+		}
+		return v, nil
+	}
+	rv := reflect.ValueOf(arg)
+	if rv.Kind() == reflect.Ptr {
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Struct {
+		return Value{}, fmt.Errorf("go-value of type [%T] is not a struct", arg)
+	}
+	if err := check_set_value(typ, rv.Type()); err != nil {
+		return Value{}, err
+	}
+	return new_value_of(typ, rv)
+}
+
+// new_value_of returns a new Value of type typ holding the go-value rv,
+// which has been checked by check_set_value.
+// Values rejected on the way, such as non-constant enum values, are
+// reported as errors.
+func new_value_of(typ Type, rv reflect.Value) (v Value, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	v = New(typ)
+	v.set_value(rv)
+	return v, nil
+}
+
+// array_arg returns the Value holding the array arg, of type typ.
+// Go arrays are copied into a new Value.
+func array_arg(typ Type, arg interface{}) (Value, error) {
+	if v, ok := arg.(Value); ok {
+		if !is_compatible(typ, v.typ) {
+			return Value{}, fmt.Errorf("can not use ffi.Value of type [%s] as c-type [%s]",
+				v.typ.Name(), typ.Name())
+		}
+		return v, nil
+	}
+	rv := reflect.ValueOf(arg)
+	if rv.Kind() == reflect.Ptr {
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Array || !is_compatible(typ, ctype_from_gotype(rv.Type())) {
+		return Value{}, fmt.Errorf("can not use go-value of type [%T] as c-type [%s]",
+			arg, typ.Name())
+	}
+	v := New(typ)
+	v.set_value(rv)
+	return v, nil
 }
 
 // void ffi_call(ffi_cif *cif,
@@ -227,11 +721,6 @@ func rtype_from_ffi(t *C.ffi_type) reflect.Type {
 // 	      void *rvalue,
 // 	      void **avalue);
 
-// Closure models a ffi closure
-type Closure struct {
-	c C.ffi_closure
-}
-
 // Library is a dl-opened library holding the corresponding dl.Handle
 type Library struct {
 	handle dl.Handle
@@ -260,13 +749,13 @@ func (lib Library) Close() error {
 }
 
 // Function is a dl-loaded function from a dl-opened library
-type Function func(args ...interface{}) reflect.Value
+type Function func(args ...interface{}) Value
 
 type cfct struct {
 	addr unsafe.Pointer
 }
 
-var nil_fct Function = func(args ...interface{}) reflect.Value {
+var nil_fct Function = func(args ...interface{}) Value {
 	panic("ffi: nil_fct called")
 }
 
@@ -284,7 +773,7 @@ func (lib Library) Fct(fctname string) (Function, error) {
 		return nil_fct, err
 	}
 
-	fct := func(args ...interface{}) reflect.Value {
+	fct := func(args ...interface{}) Value {
 		println("...call.cif...")
 		out, err := cif.Call(FctPtr{addr}, args...)
 		if err != nil {
@@ -310,7 +799,7 @@ func (lib Library) Fct(fctname string, rtype Type, argtypes []Type) (Function, e
 		return nil_fct, err
 	}
 
-	fct := func(args ...interface{}) reflect.Value {
+	fct := func(args ...interface{}) Value {
 		//println("...call.cif...")
 		out, err := cif.Call(FctPtr{addr}, args...)
 		if err != nil {
@@ -322,4 +811,260 @@ func (lib Library) Fct(fctname string, rtype Type, argtypes []Type) (Function, e
 	return Function(fct), nil
 }
 
+// ErrnoFunction is a dl-loaded function from a dl-opened library, which
+// also returns the value of errno as set by the C function.
+type ErrnoFunction func(args ...interface{}) (Value, syscall.Errno)
+
+// FctErrno returns a handle to the function fctname, with the given
+// signature, capturing errno after each call.
+func (lib Library) FctErrno(fctname string, rtype Type, argtypes []Type) (ErrnoFunction, error) {
+	sym, err := lib.handle.Symbol(fctname)
+	if err != nil {
+		return nil, err
+	}
+
+	addr := (C._go_ffi_fctptr_t)(unsafe.Pointer(sym))
+	cif, err := NewCif(DefaultAbi, rtype, argtypes)
+	if err != nil {
+		return nil, err
+	}
+
+	fct := func(args ...interface{}) (Value, syscall.Errno) {
+		out, errno, err := cif.CallErrno(FctPtr{addr}, args...)
+		if err != nil {
+			panic(err)
+		}
+		return out, errno
+	}
+	return ErrnoFunction(fct), nil
+}
+
+// Func is a dl-loaded function from a dl-opened library.
+// Contrary to Function, Func reports errors instead of panicking.
+type Func struct {
+	name string
+	addr FctPtr
+	cif  *Cif
+	vc   *var_cifs // call interfaces of variadic functions
+}
+
+// Func returns a handle to the function fctname, with the given signature.
+func (lib Library) Func(fctname string, rtype Type, argtypes []Type) (*Func, error) {
+	sym, err := lib.handle.Symbol(fctname)
+	if err != nil {
+		return nil, err
+	}
+
+	cif, err := NewCif(DefaultAbi, rtype, argtypes)
+	if err != nil {
+		return nil, err
+	}
+
+	addr := FctPtr{(C._go_ffi_fctptr_t)(unsafe.Pointer(sym))}
+	return &Func{name: fctname, addr: addr, cif: cif}, nil
+}
+
+// Name returns the name of the function.
+func (f *Func) Name() string {
+	return f.name
+}
+
+// FctPtr returns the address of the function.
+func (f *Func) FctPtr() FctPtr {
+	return f.addr
+}
+
+// Call invokes the function with the provided arguments.
+func (f *Func) Call(args ...interface{}) (Value, error) {
+	out, _, err := f.call(false, args)
+	return out, err
+}
+
+// CallErrno invokes the function with the provided arguments, also
+// returning the value of errno as set by the C function.
+func (f *Func) CallErrno(args ...interface{}) (Value, syscall.Errno, error) {
+	return f.call(true, args)
+}
+
+func (f *Func) call(with_errno bool, args []interface{}) (Value, syscall.Errno, error) {
+	if f.vc != nil {
+		return f.vc.call(f.addr, with_errno, args)
+	}
+	return f.cif.call(f.addr, with_errno, args)
+}
+
+// FctVariadic returns a handle to the variadic function fctname, taking the
+// fixed arguments argtypes.
+// The C types of the variadic arguments are derived from the Go values
+// passed after the fixed arguments, following the C default argument
+// promotions. A call interface is prepared (and cached) for each distinct
+// set of variadic argument types.
+func (lib Library) FctVariadic(fctname string, rtype Type, argtypes []Type) (Function, error) {
+	sym, err := lib.handle.Symbol(fctname)
+	if err != nil {
+		return nil_fct, err
+	}
+
+	addr := FctPtr{(C._go_ffi_fctptr_t)(unsafe.Pointer(sym))}
+	vc := new_var_cifs(rtype, argtypes)
+	fct := func(args ...interface{}) Value {
+		out, _, err := vc.call(addr, false, args)
+		if err != nil {
+			panic(err)
+		}
+		return out
+	}
+	return Function(fct), nil
+}
+
+// FuncVariadic returns a handle to the variadic function fctname, taking
+// the fixed arguments argtypes.
+// As with FctVariadic, the C types of the variadic arguments are derived
+// from the values passed after the fixed arguments.
+func (lib Library) FuncVariadic(fctname string, rtype Type, argtypes []Type) (*Func, error) {
+	sym, err := lib.handle.Symbol(fctname)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := check_cif_types(rtype, argtypes); err != nil {
+		return nil, err
+	}
+	addr := FctPtr{(C._go_ffi_fctptr_t)(unsafe.Pointer(sym))}
+	return &Func{name: fctname, addr: addr, vc: new_var_cifs(rtype, argtypes)}, nil
+}
+
+// var_cifs caches the call interfaces of a variadic function, one per
+// set of variadic argument types.
+type var_cifs struct {
+	mu    sync.Mutex
+	rtype Type
+	args  []Type // types of the fixed arguments
+	cifs  map[string]*Cif
+}
+
+func new_var_cifs(rtype Type, args []Type) *var_cifs {
+	return &var_cifs{rtype: rtype, args: args, cifs: make(map[string]*Cif)}
+}
+
+// call invokes the variadic function fct with args, also returning the
+// value of errno if with_errno is true.
+// The C types of the variadic arguments are derived from their Go values.
+func (vc *var_cifs) call(fct FctPtr, with_errno bool, args []interface{}) (Value, syscall.Errno, error) {
+	nfixed := len(vc.args)
+	if len(args) < nfixed {
+		return Value{}, 0, fmt.Errorf("ffi: invalid number of arguments. expected at least '%d', got '%d'.",
+			nfixed, len(args))
+	}
+	cargs := make([]interface{}, len(args))
+	copy(cargs, args)
+	types := make([]Type, len(args))
+	copy(types, vc.args)
+	key := ""
+	for i := nfixed; i < len(args); i++ {
+		arg, typ, err := vararg_promote(args[i])
+		if err != nil {
+			return Value{}, 0, err
+		}
+		cargs[i] = arg
+		types[i] = typ
+		key += typ.Name() + ";"
+	}
+
+	vc.mu.Lock()
+	cif, ok := vc.cifs[key]
+	if !ok {
+		var err error
+		cif, err = NewCifVar(DefaultAbi, nfixed, vc.rtype, types)
+		if err != nil {
+			vc.mu.Unlock()
+			return Value{}, 0, err
+		}
+		vc.cifs[key] = cif
+	}
+	vc.mu.Unlock()
+
+	return cif.call(fct, with_errno, cargs)
+}
+
+// vararg_promote applies the C default argument promotions to a variadic
+// argument, returning the promoted value and its C type.
+func vararg_promote(arg interface{}) (interface{}, Type, error) {
+	if v, ok := arg.(Value); ok {
+		return vararg_promote_value(v)
+	}
+	rv := reflect.ValueOf(arg)
+	switch rv.Kind() {
+	case reflect.Bool:
+		if rv.Bool() {
+			return int32(1), C_int32, nil
+		}
+		return int32(0), C_int32, nil
+	case reflect.Uintptr:
+		return arg, C_uintptr_t, nil
+	case reflect.UnsafePointer:
+		return arg, C_pointer, nil
+	case reflect.Int8, reflect.Int16, reflect.Int32:
+		return int32(rv.Int()), C_int32, nil
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return uint32(rv.Uint()), C_uint32, nil
+	case reflect.Int, reflect.Int64:
+		if rv.Kind() == reflect.Int && strconv.IntSize == 32 {
+			return arg, C_int32, nil
+		}
+		return arg, C_int64, nil
+	case reflect.Uint, reflect.Uint64:
+		if rv.Kind() == reflect.Uint && strconv.IntSize == 32 {
+			return arg, C_uint32, nil
+		}
+		return arg, C_uint64, nil
+	case reflect.Float32:
+		return rv.Float(), C_double, nil
+	case reflect.Float64:
+		return arg, C_double, nil
+	case reflect.String:
+		return arg, C_pointer, nil
+	case reflect.Ptr:
+		// pointer arguments are passed as the value they point at,
+		// nil pointers as a NULL pointer
+		if rv.IsNil() {
+			return nil, C_pointer, nil
+		}
+		switch rv.Elem().Kind() {
+		case reflect.UnsafePointer, reflect.Uintptr:
+			return arg, C_pointer, nil
+		}
+		_, typ, err := vararg_promote(rv.Elem().Interface())
+		if err != nil {
+			return nil, nil, err
+		}
+		if typ.Size() != rv.Elem().Type().Size() {
+			return nil, nil, fmt.Errorf("ffi: variadic argument of type [%T] needs promotion and can not be passed by pointer", arg)
+		}
+		return arg, typ, nil
+	}
+	return nil, nil, fmt.Errorf("ffi: unsupported variadic argument type [%T]", arg)
+}
+
+// vararg_promote_value applies the C default argument promotions to a
+// variadic argument held by a Value: integers smaller than an int are
+// passed as an int and floats as a double, other values as they are.
+func vararg_promote_value(v Value) (interface{}, Type, error) {
+	if v.typ == nil {
+		return nil, nil, fmt.Errorf("ffi: invalid Value as variadic argument")
+	}
+	small := v.typ.Size() < C_int.Size()
+	switch k := v.Kind(); {
+	case is_signed(k) && small:
+		return int32(v.Int()), C_int32, nil
+	case is_unsigned(k) && small:
+		return int32(v.Uint()), C_int32, nil
+	case k == Float:
+		return v.Float(), C_double, nil
+	case k == Void:
+		return nil, nil, fmt.Errorf("ffi: variadic argument of type [%s]", v.typ.Name())
+	}
+	return v, v.typ, nil
+}
+
 // EOF
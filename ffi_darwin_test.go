@@ -2,5 +2,9 @@ package ffi_test
 
 var libc_name = "libc.dylib"
 var libm_name = "libm.dylib"
+var libpthread_name = "libpthread.dylib"
+
+// printf representation of a NULL pointer
+var null_ptr_str = "0x0"
 
 // EOF
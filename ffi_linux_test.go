@@ -2,5 +2,9 @@ package ffi_test
 
 var libc_name = "libc.so.6"
 var libm_name = "libm.so.6"
+var libpthread_name = "libpthread.so.0"
+
+// printf representation of a NULL pointer
+var null_ptr_str = "(nil)"
 
 // EOF
@@ -1,11 +1,15 @@
 package ffi_test
 
 import (
+	"fmt"
 	"math"
+	"os"
 	"path"
 	"reflect"
 	"runtime"
+	"syscall"
 	"testing"
+	"unsafe"
 
 	ffi "github.com/sbinet/go-ffi"
 )
@@ -152,6 +156,100 @@ func TestFFIStrLen(t *testing.T) {
 	}
 }
 
+func TestFFIString(t *testing.T) {
+	lib, err := ffi.NewLibrary(libc_name)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer lib.Close()
+
+	// char *getenv(const char *name);
+	getenv, err := lib.Func("getenv", ffi.C_string, []ffi.Type{ffi.C_string})
+	if err != nil {
+		t.Fatalf("could not locate function [getenv]: %v", err)
+	}
+	for _, n := range []string{"PATH", "GO_FFI_NOT_SET"} {
+		out, err := getenv.Call(n)
+		if err != nil {
+			t.Fatalf("getenv(%q): %v", n, err)
+		}
+		eq(t, os.Getenv(n), out.String())
+	}
+
+	// char *strdup(const char *s);
+	strdup, err := lib.Func("strdup",
+		ffi.NewStringType(ffi.StringCallerFrees),
+		[]ffi.Type{ffi.C_string},
+	)
+	if err != nil {
+		t.Fatalf("could not locate function [strdup]: %v", err)
+	}
+	out, err := strdup.Call("foo-bar")
+	if err != nil {
+		t.Fatalf("strdup: %v", err)
+	}
+	eq(t, "foo-bar", out.String())
+
+	// size_t strlen(const char *s);
+	strlen, err := lib.Func("strlen", ffi.C_uint64, []ffi.Type{ffi.C_string})
+	if err != nil {
+		t.Fatalf("could not locate function [strlen]: %v", err)
+	}
+	for _, arg := range []interface{}{"foo", out, ffi.ValueOf("")} {
+		out, err := strlen.Call(arg)
+		if err != nil {
+			t.Fatalf("strlen(%v): %v", arg, err)
+		}
+		var n int
+		switch arg := arg.(type) {
+		case string:
+			n = len(arg)
+		case ffi.Value:
+			n = len(arg.String())
+		}
+		eq(t, uint64(n), out.Uint())
+	}
+	_, err = strlen.Call(42)
+	if err == nil {
+		t.Errorf("expected an error passing an int as a C string")
+	}
+}
+
+func TestFFIOutParameter(t *testing.T) {
+	lib, err := ffi.NewLibrary(libc_name)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer lib.Close()
+
+	// long strtol(const char *nptr, char **endptr, int base);
+	strtol, err := lib.Func("strtol", ffi.C_long,
+		[]ffi.Type{ffi.C_string, ffi.PtrTo(ffi.C_string), ffi.C_int32},
+	)
+	if err != nil {
+		t.Fatalf("could not locate function [strtol]: %v", err)
+	}
+
+	// endptr points into nptr: it must outlive the call.
+	nptr := ffi.ValueOf("1234 rest")
+	end := ffi.New(ffi.C_string)
+	out, err := strtol.Call(nptr, end.Addr(), 10)
+	if err != nil {
+		t.Fatalf("strtol: %v", err)
+	}
+	eq(t, int64(1234), out.Int())
+	eq(t, " rest", end.String())
+
+	_, err = strtol.Call("1234", nil, 10)
+	if err != nil {
+		t.Fatalf("strtol: %v", err)
+	}
+	_, err = strtol.Call("1234", ffi.New(ffi.C_int32), 10)
+	if err == nil {
+		t.Errorf("expected an error passing an int as a char**")
+	}
+}
+
 func TestFFIStrCat(t *testing.T) {
 	lib, err := ffi.NewLibrary(libc_name)
 
@@ -181,4 +279,1284 @@ func TestFFIStrCat(t *testing.T) {
 	}
 }
 
+func TestClosure(t *testing.T) {
+	cif, err := ffi.NewCif(ffi.DefaultAbi, ffi.C_int, []ffi.Type{ffi.C_int, ffi.C_int})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	add, err := ffi.NewClosure(cif, func(a, b int) int {
+		return a + b
+	})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer add.Free()
+
+	out, err := cif.Call(add.FctPtr(), 40, 2)
+	if err != nil {
+		t.Errorf("%v", err)
+	}
+	eq(t, int64(42), out.Int())
+
+	_, err = ffi.NewClosure(cif, func(a int) int { return a })
+	if err == nil {
+		t.Errorf("failed to detect invalid number of arguments")
+	}
+
+	// signatures are checked when creating the closure
+	for _, fct := range []interface{}{
+		func(a string, b int) int { return b },
+		func(a, b float64) int { return 0 },
+		func(a, b int) string { return "" },
+		func(a, b int) unsafe.Pointer { return nil },
+		func(a, b int) struct{ X int } { return struct{ X int }{} },
+	} {
+		_, err = ffi.NewClosure(cif, fct)
+		if err == nil {
+			t.Errorf("failed to detect invalid signature [%T]", fct)
+		}
+	}
+
+	// integers are converted to any go integer type
+	sub, err := ffi.NewClosure(cif, func(a uint8, b int64) uint16 {
+		return uint16(a) - uint16(b)
+	})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer sub.Free()
+	out, err = cif.Call(sub.FctPtr(), 2, 3)
+	if err != nil {
+		t.Errorf("%v", err)
+	}
+	eq(t, int64(0xffff), out.Int())
+}
+
+func TestClosureThread(t *testing.T) {
+	lib, err := ffi.NewLibrary(libpthread_name)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer lib.Close()
+
+	// int pthread_create(pthread_t *thread, const pthread_attr_t *attr,
+	//                    void *(*start_routine) (void *), void *arg);
+	create, err := lib.Func("pthread_create", ffi.C_int,
+		[]ffi.Type{ffi.C_pointer, ffi.C_pointer, ffi.C_pointer, ffi.C_pointer})
+	if err != nil {
+		t.Fatalf("could not locate function [pthread_create]: %v", err)
+	}
+	// int pthread_join(pthread_t thread, void **retval);
+	join, err := lib.Func("pthread_join", ffi.C_int, []ffi.Type{ffi.C_uintptr_t, ffi.C_pointer})
+	if err != nil {
+		t.Fatalf("could not locate function [pthread_join]: %v", err)
+	}
+
+	cif, err := ffi.NewCif(ffi.DefaultAbi, ffi.C_pointer, []ffi.Type{ffi.C_pointer})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	ncalls := 0
+	start, err := ffi.NewClosure(cif, func(arg unsafe.Pointer) unsafe.Pointer {
+		ncalls++
+		return arg
+	})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer start.Free()
+
+	const nthreads = 4
+	for i := 0; i < nthreads; i++ {
+		tid := ffi.New(ffi.C_uintptr_t)
+		out, err := create.Call(tid.Addr(), nil, start.FctPtr(), nil)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		eq(t, int64(0), out.Int())
+		out, err = join.Call(tid, nil)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		eq(t, int64(0), out.Int())
+	}
+	eq(t, nthreads, ncalls)
+}
+
+func TestFFIUnion(t *testing.T) {
+	dbl_long, err := ffi.NewStructTypeLayout("struct_dbl_long", []ffi.Field{
+		{"D", ffi.C_double},
+		{"L", ffi.C_int64},
+	}, ffi.StructLayout{Align: 16})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	for _, table := range []struct {
+		name   string
+		fields []ffi.Field
+	}{
+		// classified as an integer
+		{"union_num", []ffi.Field{{"I", ffi.C_int64}, {"D", ffi.C_double}}},
+		// classified as a floating point
+		{"union_real", []ffi.Field{{"F", ffi.C_float}, {"D", ffi.C_double}}},
+		// classified per eightbyte: a floating point, then an integer
+		{"union_aligned", []ffi.Field{{"S", dbl_long}, {"D", ffi.C_double}}},
+	} {
+		typ, err := ffi.NewUnionType(table.name, table.fields)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		cif, err := ffi.NewCif(ffi.DefaultAbi, typ, []ffi.Type{ffi.C_int32, typ})
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		twice, err := ffi.NewClosure(cif, func(n int32, u ffi.Value) ffi.Value {
+			out := ffi.New(typ)
+			out.Field(1).SetFloat(float64(n) * u.Field(1).Float())
+			return out
+		})
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		defer twice.Free()
+
+		arg := ffi.New(typ)
+		arg.Field(1).SetFloat(21)
+		out, err := cif.Call(twice.FctPtr(), 2, arg)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		eq(t, typ, out.Type())
+		eq(t, 42.0, out.Field(1).Float())
+
+		_, err = cif.Call(twice.FctPtr(), 2, 42.0)
+		if err == nil {
+			t.Errorf("expected an error passing a float64 as a union")
+		}
+	}
+
+	// long doubles sharing their bytes with other members are passed in
+	// memory by the C compiler, which libffi can not be told
+	for _, table := range []struct {
+		name   string
+		fields []ffi.Field
+		ok     bool
+	}{
+		{"union_ldbl", []ffi.Field{{"A", ffi.C_longdouble}, {"B", ffi.C_longdouble}}, true},
+		{"union_ldbl_int", []ffi.Field{{"LD", ffi.C_longdouble}, {"X", ffi.C_int}}, false},
+		{"union_ldbl_dbl", []ffi.Field{{"LD", ffi.C_longdouble}, {"D", ffi.C_double}}, false},
+	} {
+		typ, err := ffi.NewUnionType(table.name, table.fields)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		_, err = ffi.NewCif(ffi.DefaultAbi, typ, []ffi.Type{typ})
+		if table.ok && err != nil {
+			t.Errorf("%s: %v", table.name, err)
+		}
+		if !table.ok && err == nil {
+			t.Errorf("%s: expected an error passing the union by value", table.name)
+		}
+		_, err = ffi.NewCif(ffi.DefaultAbi, ffi.C_void, []ffi.Type{ffi.PtrTo(typ)})
+		if err != nil {
+			t.Errorf("%s: %v", table.name, err)
+		}
+	}
+}
+
+func TestFFIZeroSized(t *testing.T) {
+	zarr, err := ffi.NewArrayType(0, ffi.C_int32)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	// struct { int32_t a; int32_t z[0]; int32_t b; }
+	typ, err := ffi.NewStructType("struct_zero_member", []ffi.Field{
+		{"a", ffi.C_int32},
+		{"z", zarr},
+		{"b", ffi.C_int32},
+	})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	eq(t, uintptr(8), typ.Size())
+	eq(t, uintptr(4), typ.Field(1).Offset)
+	eq(t, uintptr(4), typ.Field(2).Offset)
+
+	cif, err := ffi.NewCif(ffi.DefaultAbi, typ, []ffi.Type{typ})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	swap, err := ffi.NewClosure(cif, func(v ffi.Value) ffi.Value {
+		out := ffi.New(typ)
+		out.Field(0).SetInt(v.Field(2).Int())
+		out.Field(2).SetInt(v.Field(0).Int())
+		return out
+	})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer swap.Free()
+	arg := ffi.New(typ)
+	arg.Field(0).SetInt(1)
+	arg.Field(2).SetInt(2)
+	out, err := cif.Call(swap.FctPtr(), arg)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	eq(t, int64(2), out.Field(0).Int())
+	eq(t, int64(1), out.Field(2).Int())
+
+	// go structs with zero-length arrays
+	gtyp := ffi.TypeOf(struct {
+		C byte
+		Z [0]int32
+	}{})
+	eq(t, uintptr(4), gtyp.Size())
+	eq(t, uintptr(4), gtyp.Field(1).Offset)
+	_, err = ffi.NewCif(ffi.DefaultAbi, ffi.C_void, []ffi.Type{gtyp})
+	if err != nil {
+		t.Errorf("%v", err)
+	}
+
+	// zero-sized structs can not be passed by value
+	empty, err := ffi.NewStructType("struct_zero_sized", []ffi.Field{{"z", zarr}})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	eq(t, uintptr(0), empty.Size())
+	eq(t, 4, empty.Align())
+	_, err = ffi.NewCif(ffi.DefaultAbi, ffi.C_void, []ffi.Type{empty})
+	if err == nil {
+		t.Errorf("expected an error passing a zero-sized struct by value")
+	}
+}
+
+func TestFFIBitfield(t *testing.T) {
+	flags, _ := ffi.NewBitfieldType(ffi.C_uint8, 1)
+	delta, _ := ffi.NewBitfieldType(ffi.C_int64, 40)
+	// struct {double d; unsigned char f:1; long long g:40; float h;}
+	typ, err := ffi.NewStructType("bitfield_arg", []ffi.Field{
+		{"D", ffi.C_double},
+		{"F", flags},
+		{"G", delta},
+		{"H", ffi.C_float},
+	})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	cif, err := ffi.NewCif(ffi.DefaultAbi, ffi.C_int64, []ffi.Type{typ})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	get, err := ffi.NewClosure(cif, func(v ffi.Value) int64 {
+		return v.Bitfield(2) + int64(v.Field(3).Float())
+	})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer get.Free()
+
+	arg := ffi.New(typ)
+	arg.SetBitfield(1, 1)
+	arg.SetBitfield(2, -1<<38)
+	arg.Field(3).SetFloat(2)
+	out, err := cif.Call(get.FctPtr(), arg)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	eq(t, int64(-1<<38+2), out.Int())
+}
+
+func TestFFIEnum(t *testing.T) {
+	lib, err := ffi.NewLibrary(libc_name)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer lib.Close()
+
+	typ, err := ffi.NewEnumType("enum_sign", ffi.C_int, map[string]int64{
+		"NEGATIVE": -1,
+		"POSITIVE": 1,
+	})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	abs, err := lib.Func("abs", typ, []ffi.Type{typ})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	out, err := abs.Call(-1)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	eq(t, typ, out.Type())
+	eq(t, int64(1), out.Int())
+	eq(t, "POSITIVE", out.String())
+
+	// enum values are passed as they are
+	neg := ffi.New(typ)
+	neg.SetInt(-1)
+	out, err = abs.Call(neg)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	eq(t, "POSITIVE", out.String())
+
+	// values of the underlying type holding a constant are accepted
+	one := ffi.New(ffi.C_int)
+	one.SetInt(1)
+	out, err = abs.Call(one)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	eq(t, "POSITIVE", out.String())
+
+	other, err := ffi.NewEnumType("enum_other", ffi.C_int, map[string]int64{"ZERO": 0})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	zero := ffi.New(other)
+	zero.SetInt(0)
+
+	// values which are not constants of the enum are rejected
+	one.SetInt(2)
+	for _, arg := range []interface{}{2, uint8(0), false, one, zero} {
+		_, err = abs.Call(arg)
+		if err == nil {
+			t.Fatalf("expected an error passing [%v] as [%s]", arg, typ.Name())
+		}
+		if _, ok := err.(*ffi.ArgumentError); !ok {
+			t.Fatalf("expected an *ffi.ArgumentError, got %T (%v)", err, err)
+		}
+	}
+}
+
+func TestFFIFunctionPointer(t *testing.T) {
+	lib, err := ffi.NewLibrary(libc_name)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer lib.Close()
+
+	// struct {
+	//   size_t (*len)(const char*);
+	//   int (*cmp)(const void*, const void*);
+	//   int (*print)(char*, size_t, const char*, ...);
+	// }
+	len_t, err := ffi.NewFunctionType(ffi.C_size_t, []ffi.Type{ffi.C_string}, false)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	cmp_t, err := ffi.NewFunctionType(ffi.C_int, []ffi.Type{ffi.C_pointer, ffi.C_pointer}, false)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	print_t, err := ffi.NewFunctionType(ffi.C_int,
+		[]ffi.Type{ffi.C_pointer, ffi.C_size_t, ffi.C_string}, true)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	typ := mustStruct(t, "vtable", []ffi.Field{
+		{"len", len_t},
+		{"cmp", cmp_t},
+		{"print", print_t},
+	})
+	vtbl := ffi.New(typ)
+	eq(t, true, vtbl.Field(0).IsNil())
+	_, err = vtbl.Field(0).Call("foo")
+	if err == nil {
+		t.Errorf("expected an error calling a nil function pointer")
+	}
+
+	for i, n := range map[int]string{0: "strlen", 2: "snprintf"} {
+		f, err := lib.Func(n, ffi.C_void, nil)
+		if err != nil {
+			t.Fatalf("could not locate function [%s]: %v", n, err)
+		}
+		vtbl.Field(i).SetFctPtr(f.FctPtr())
+	}
+	out, err := vtbl.Field(0).Call("hello")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	eq(t, uint64(5), out.Uint())
+
+	var buf [32]byte
+	ptr := unsafe.Pointer(&buf[0])
+	out, err = vtbl.Field(2).Call(&ptr, uint64(len(buf)), "%d-%s", 42, "foo")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	eq(t, "42-foo", string(buf[:out.Int()]))
+
+	// store a go callback, and hand it over to C
+	ncalls := 0
+	cmp, err := vtbl.Field(1).SetFunc(func(a, b unsafe.Pointer) int32 {
+		ncalls++
+		return *(*int32)(a) - *(*int32)(b)
+	})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer cmp.Free()
+	eq(t, false, vtbl.Field(1).IsNil())
+
+	x, y := int32(1), int32(3)
+	out, err = vtbl.Field(1).Call(unsafe.Pointer(&x), unsafe.Pointer(&y))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	eq(t, int64(-2), out.Int())
+
+	// void qsort(void *base, size_t nmemb, size_t size,
+	//            int (*compar)(const void *, const void *));
+	qsort, err := lib.Func("qsort", ffi.C_void,
+		[]ffi.Type{ffi.C_pointer, ffi.C_size_t, ffi.C_size_t, cmp_t})
+	if err != nil {
+		t.Fatalf("could not locate function [qsort]: %v", err)
+	}
+	arr := [5]int32{5, 3, 4, 1, 2}
+	base := unsafe.Pointer(&arr[0])
+	_, err = qsort.Call(&base, uint64(len(arr)), uint64(unsafe.Sizeof(arr[0])), vtbl.Field(1))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	eq(t, [5]int32{1, 2, 3, 4, 5}, arr)
+	if ncalls < 2 {
+		t.Errorf("comparison callback was not called by qsort")
+	}
+
+	_, err = qsort.Call(&base, uint64(len(arr)), uint64(unsafe.Sizeof(arr[0])), vtbl.Field(0))
+	if err == nil {
+		t.Errorf("expected an error passing a function pointer of the wrong type")
+	}
+}
+
+func TestFFIBoolPointer(t *testing.T) {
+	lib, err := ffi.NewLibrary(libc_name)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer lib.Close()
+
+	// void *memchr(const void *s, int c, size_t n);
+	memchr, err := lib.Func("memchr", ffi.C_pointer, []ffi.Type{ffi.C_pointer, ffi.C_int, ffi.C_size_t})
+	if err != nil {
+		t.Fatalf("could not locate function [memchr]: %v", err)
+	}
+	buf := []byte("abcdef")
+	p := unsafe.Pointer(&buf[0])
+	out, err := memchr.Call(p, int32('c'), uintptr(len(buf)))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	eq(t, unsafe.Pointer(&buf[2]), out.Pointer())
+	eq(t, unsafe.Pointer(&buf[2]), out.GoValue().Interface())
+	out, err = memchr.Call(p, int32('z'), uintptr(len(buf)))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	eq(t, true, out.IsNil())
+
+	// int isdigit(int c);
+	isdigit, err := lib.Func("isdigit", ffi.C_int, []ffi.Type{ffi.C_int})
+	if err != nil {
+		t.Fatalf("could not locate function [isdigit]: %v", err)
+	}
+	out, err = isdigit.Call('7')
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	eq(t, true, out.Bool())
+
+	// int abs(int j);
+	abs, err := lib.Func("abs", ffi.C_int, []ffi.Type{ffi.C_int})
+	if err != nil {
+		t.Fatalf("could not locate function [abs]: %v", err)
+	}
+	out, err = abs.Call(true)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	eq(t, int64(1), out.Int())
+	_, err = abs.Call(unsafe.Pointer(nil))
+	if err == nil {
+		t.Errorf("expected an error passing an unsafe.Pointer as an int")
+	}
+
+	// _Bool not(_Bool b);
+	cif, err := ffi.NewCif(ffi.DefaultAbi, ffi.C_bool, []ffi.Type{ffi.C_bool})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	not, err := ffi.NewClosure(cif, func(b bool) bool { return !b })
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer not.Free()
+	for _, b := range []bool{false, true} {
+		out, err = cif.Call(not.FctPtr(), b)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		eq(t, !b, out.Bool())
+		eq(t, !b, out.GoValue().Interface())
+	}
+}
+
+func TestFFIOpaque(t *testing.T) {
+	lib, err := ffi.NewLibrary(libc_name)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer lib.Close()
+
+	file_t, err := ffi.NewOpaqueType("FILE")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	pfile_t := ffi.PtrTo(file_t)
+
+	// FILE *fopen(const char *path, const char *mode);
+	fopen, err := lib.Func("fopen", pfile_t, []ffi.Type{ffi.C_string, ffi.C_string})
+	if err != nil {
+		t.Fatalf("could not locate function [fopen]: %v", err)
+	}
+	// int fileno(FILE *stream);
+	fileno, err := lib.Func("fileno", ffi.C_int, []ffi.Type{pfile_t})
+	if err != nil {
+		t.Fatalf("could not locate function [fileno]: %v", err)
+	}
+	// int fclose(FILE *stream);
+	fclose, err := lib.Func("fclose", ffi.C_int, []ffi.Type{pfile_t})
+	if err != nil {
+		t.Fatalf("could not locate function [fclose]: %v", err)
+	}
+
+	f, err := fopen.Call(os.DevNull, "r")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	eq(t, pfile_t, f.Type())
+	if f.IsNil() {
+		t.Fatalf("fopen(%q) failed", os.DevNull)
+	}
+	fd, err := fileno.Call(f)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if fd.Int() < 0 {
+		t.Errorf("invalid file descriptor (%d)", fd.Int())
+	}
+
+	// typed handles are distinct from void* and from other handles
+	buf := ffi.New(ffi.C_int)
+	vptr := ffi.New(ffi.C_pointer)
+	vptr.SetPointer(buf.Addr().Pointer())
+	_, err = fileno.Call(vptr)
+	if err == nil {
+		t.Errorf("expected an error passing a void* as a FILE*")
+	}
+	dir_t, err := ffi.NewOpaqueType("DIR")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	_, err = fileno.Call(ffi.New(ffi.PtrTo(dir_t)))
+	if err == nil {
+		t.Errorf("expected an error passing a DIR* as a FILE*")
+	}
+
+	out, err := fclose.Call(f)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	eq(t, int64(0), out.Int())
+}
+
+func TestFFIArray(t *testing.T) {
+	lib, err := ffi.NewLibrary(libc_name)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer lib.Close()
+
+	// arrays decay to pointers
+	arr, _ := ffi.NewArrayType(6, ffi.C_uint8)
+	strlen, err := lib.Func("strlen", ffi.C_uint64, []ffi.Type{arr})
+	if err != nil {
+		t.Fatalf("could not locate function [strlen]: %v", err)
+	}
+	hello := [6]byte{'h', 'e', 'l', 'l', 'o', 0}
+	for _, arg := range []interface{}{hello, &hello, ffi.ValueOf(hello)} {
+		out, err := strlen.Call(arg)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		eq(t, uint64(5), out.Uint())
+	}
+	_, err = strlen.Call([3]byte{})
+	if err == nil {
+		t.Errorf("expected an error passing a [3]byte as a uint8[6]")
+	}
+
+	// structs with array members, by value
+	float3, _ := ffi.NewArrayType(3, ffi.C_float)
+	char16, _ := ffi.NewArrayType(16, ffi.C_int8)
+	for _, typ := range []ffi.Type{
+		// struct {float v[3];}, passed in SSE registers
+		mustStruct(t, "vec3", []ffi.Field{{"V", float3}}),
+		// struct {char name[16]; float v[3];}, passed in memory
+		mustStruct(t, "named_vec3", []ffi.Field{{"Name", char16}, {"V", float3}}),
+	} {
+		cif, err := ffi.NewCif(ffi.DefaultAbi, ffi.C_double, []ffi.Type{typ, arr})
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		sum, err := ffi.NewClosure(cif, func(v ffi.Value, a ffi.Value) float64 {
+			vec := v.FieldByName("V")
+			x := 0.0
+			for i := 0; i < vec.Len(); i++ {
+				x += vec.Index(i).Float()
+			}
+			return x + float64(a.Index(0).Uint())
+		})
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		defer sum.Free()
+
+		v := ffi.New(typ)
+		vec := v.FieldByName("V")
+		for i := 0; i < vec.Len(); i++ {
+			vec.Index(i).SetFloat(float64(i) + 0.5)
+		}
+		out, err := cif.Call(sum.FctPtr(), v, [6]byte{100})
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		eq(t, 104.5, out.Float())
+	}
+}
+
+func mustStruct(t *testing.T, name string, fields []ffi.Field) ffi.Type {
+	typ, err := ffi.NewStructType(name, fields)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	return typ
+}
+
+func TestClosureQsort(t *testing.T) {
+	lib, err := ffi.NewLibrary(libc_name)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer lib.Close()
+
+	// void qsort(void *base, size_t nmemb, size_t size,
+	//            int (*compar)(const void *, const void *));
+	qsort, err := lib.Fct("qsort", ffi.C_void,
+		[]ffi.Type{ffi.C_pointer, ffi.C_ulong, ffi.C_ulong, ffi.C_pointer})
+	if err != nil {
+		t.Fatalf("could not locate function [qsort]: %v", err)
+	}
+
+	cif, err := ffi.NewCif(ffi.DefaultAbi, ffi.C_int, []ffi.Type{ffi.C_pointer, ffi.C_pointer})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	ncalls := 0
+	cmp, err := ffi.NewClosure(cif, func(a, b unsafe.Pointer) int32 {
+		ncalls++
+		return *(*int32)(a) - *(*int32)(b)
+	})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer cmp.Free()
+
+	arr := [5]int32{5, 3, 4, 1, 2}
+	base := unsafe.Pointer(&arr[0])
+	qsort(&base, uint64(len(arr)), uint64(unsafe.Sizeof(arr[0])), cmp.FctPtr())
+
+	eq(t, [5]int32{1, 2, 3, 4, 5}, arr)
+	if ncalls == 0 {
+		t.Errorf("comparison closure was never called")
+	}
+}
+
+func TestFFISnprintf(t *testing.T) {
+	lib, err := ffi.NewLibrary(libc_name)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer lib.Close()
+
+	//int snprintf(char *str, size_t size, const char *format, ...);
+	f, err := lib.FctVariadic("snprintf", ffi.C_int,
+		[]ffi.Type{ffi.C_pointer, ffi.C_ulong, ffi.C_pointer})
+	if err != nil {
+		t.Fatalf("could not locate function [snprintf]: %v", err)
+	}
+
+	for _, table := range []struct {
+		format string
+		args   []interface{}
+		res    string
+	}{
+		{"hello", nil, "hello"},
+		{"%d-%s", []interface{}{42, "foo"}, "42-foo"},
+		{"%d|%u|%.2f", []interface{}{int8(-2), uint16(3), float32(1.5)}, "-2|3|1.50"},
+		{"%.3f %ld", []interface{}{math.Pi, int64(-1) << 40}, "3.142 -1099511627776"},
+		{"%d-%s", []interface{}{7, "bar"}, "7-bar"},
+		{"%p", []interface{}{(*int32)(nil)}, null_ptr_str},
+	} {
+		var buf [64]byte
+		ptr := unsafe.Pointer(&buf[0])
+		args := append([]interface{}{&ptr, uint64(len(buf)), table.format}, table.args...)
+		n := int(f(args...).Int())
+		eq(t, len(table.res), n)
+		eq(t, table.res, string(buf[:n]))
+	}
+
+	// variadic functions reporting errors, with ffi.Value arguments
+	snprintf, err := lib.FuncVariadic("snprintf", ffi.C_int,
+		[]ffi.Type{ffi.C_pointer, ffi.C_ulong, ffi.C_pointer})
+	if err != nil {
+		t.Fatalf("could not locate function [snprintf]: %v", err)
+	}
+	i8 := ffi.New(ffi.C_int8)
+	i8.SetInt(-3)
+	u16 := ffi.New(ffi.C_uint16)
+	u16.SetUint(65535)
+	f32 := ffi.New(ffi.C_float)
+	f32.SetFloat(2.5)
+	i64 := ffi.New(ffi.C_int64)
+	i64.SetInt(-1 << 40)
+	str := ffi.New(ffi.C_string)
+	str.SetString("baz")
+	for _, table := range []struct {
+		format string
+		args   []interface{}
+		res    string
+	}{
+		{"%d|%d|%.1f", []interface{}{i8, u16, f32}, "-3|65535|2.5"},
+		{"%lld-%s", []interface{}{i64, str}, "-1099511627776-baz"},
+		{"%d-%s", []interface{}{7, "bar"}, "7-bar"},
+	} {
+		var buf [64]byte
+		ptr := unsafe.Pointer(&buf[0])
+		args := append([]interface{}{&ptr, uint64(len(buf)), table.format}, table.args...)
+		out, err := snprintf.Call(args...)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		n := int(out.Int())
+		eq(t, len(table.res), n)
+		eq(t, table.res, string(buf[:n]))
+	}
+	var buf [8]byte
+	ptr := unsafe.Pointer(&buf[0])
+	_, err = snprintf.Call(&ptr, uint64(len(buf)), "%d", make(chan int))
+	if err == nil {
+		t.Errorf("expected an error passing an unsupported variadic argument")
+	}
+	_, err = snprintf.Call(&ptr)
+	if err == nil {
+		t.Errorf("expected an error passing too few arguments")
+	}
+	_, err = lib.FuncVariadic("no_such_function", ffi.C_int, nil)
+	if err == nil {
+		t.Errorf("expected an error locating a missing function")
+	}
+}
+
+func TestFFIStructReturn(t *testing.T) {
+	lib, err := ffi.NewLibrary(libc_name)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer lib.Close()
+
+	div_t, err := ffi.NewStructType("div_t", []ffi.Field{
+		{"quot", ffi.C_int},
+		{"rem", ffi.C_int},
+	})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	//div_t div(int numerator, int denominator);
+	f, err := lib.Fct("div", div_t, []ffi.Type{ffi.C_int, ffi.C_int})
+	if err != nil {
+		t.Fatalf("could not locate function [div]: %v", err)
+	}
+	out := f(17, 5)
+	eq(t, div_t, out.Type())
+	eq(t, int64(3), out.FieldByName("quot").Int())
+	eq(t, int64(2), out.FieldByName("rem").Int())
+}
+
+func TestFFIStructArg(t *testing.T) {
+	point, err := ffi.NewStructType("point", []ffi.Field{
+		{"x", ffi.C_int32},
+		{"y", ffi.C_int32},
+		{"w", ffi.C_double},
+	})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	cif, err := ffi.NewCif(ffi.DefaultAbi, point, []ffi.Type{point, ffi.C_int32})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	// scale returns its point argument, scaled by n.
+	scale, err := ffi.NewClosure(cif, func(p ffi.Value, n int32) ffi.Value {
+		out := ffi.New(point)
+		out.Field(0).SetInt(p.Field(0).Int() * int64(n))
+		out.Field(1).SetInt(p.Field(1).Int() * int64(n))
+		out.Field(2).SetFloat(p.Field(2).Float() * float64(n))
+		return out
+	})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer scale.Free()
+
+	type Point struct {
+		X, Y int32
+		W    float64
+	}
+
+	cpt := ffi.New(point)
+	cpt.Field(0).SetInt(1)
+	cpt.Field(1).SetInt(-2)
+	cpt.Field(2).SetFloat(0.5)
+
+	for _, arg := range []interface{}{
+		cpt,
+		Point{1, -2, 0.5},
+		&Point{1, -2, 0.5},
+	} {
+		out, err := cif.Call(scale.FctPtr(), arg, int32(3))
+		if err != nil {
+			t.Errorf("%v", err)
+			continue
+		}
+		eq(t, int64(3), out.Field(0).Int())
+		eq(t, int64(-6), out.Field(1).Int())
+		eq(t, 1.5, out.Field(2).Float())
+	}
+
+	for _, arg := range []interface{}{
+		42,
+		struct{ X, Y int32 }{1, 2},
+		struct {
+			X, Y int32
+			W    string
+		}{1, 2, "3"},
+		struct {
+			X, Y int32
+			W    []float64
+		}{1, 2, nil},
+	} {
+		_, err = cif.Call(scale.FctPtr(), arg, int32(3))
+		if err == nil {
+			t.Errorf("failed to detect invalid struct argument [%T]", arg)
+			continue
+		}
+		aerr, ok := err.(*ffi.ArgumentError)
+		if !ok {
+			t.Errorf("expected an *ffi.ArgumentError, got %T (%v)", err, err)
+			continue
+		}
+		if aerr.Err == nil {
+			t.Errorf("missing conversion error for struct argument [%T]", arg)
+		}
+	}
+}
+
+func TestFunc(t *testing.T) {
+	lib, err := ffi.NewLibrary(libm_name)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer lib.Close()
+
+	_, err = lib.Func("no_such_function", ffi.C_double, []ffi.Type{ffi.C_double})
+	if err == nil {
+		t.Errorf("failed to detect missing symbol")
+	}
+
+	f, err := lib.Func("cos", ffi.C_double, []ffi.Type{ffi.C_double})
+	if err != nil {
+		t.Fatalf("could not locate function [cos]: %v", err)
+	}
+	eq(t, "cos", f.Name())
+
+	out, err := f.Call(0.)
+	if err != nil {
+		t.Errorf("%v", err)
+	}
+	eq(t, ffi.C_double, out.Type())
+	eq(t, 1., out.Float())
+
+	_, err = f.Call()
+	if err == nil {
+		t.Errorf("failed to detect invalid number of arguments")
+	}
+
+	for _, arg := range []interface{}{
+		"foo",
+		nil,
+		[]float64{1},
+		struct{}{},
+	} {
+		_, err = f.Call(arg)
+		if err == nil {
+			t.Errorf("failed to detect invalid argument [%T]", arg)
+			continue
+		}
+		aerr, ok := err.(*ffi.ArgumentError)
+		if !ok {
+			t.Errorf("expected a *ffi.ArgumentError, got [%T]", err)
+			continue
+		}
+		eq(t, 0, aerr.Index)
+		eq(t, ffi.C_double, aerr.CType)
+		eq(t, reflect.TypeOf(arg), aerr.GoType)
+	}
+}
+
+func TestCifCallConvert(t *testing.T) {
+	for _, table := range []struct {
+		t   ffi.Type
+		arg interface{}
+		ok  bool
+	}{
+		{ffi.C_int8, int64(-128), true},
+		{ffi.C_int8, 127, true},
+		{ffi.C_int8, 128, false},
+		{ffi.C_int8, uint8(255), false},
+		{ffi.C_uint8, 255, true},
+		{ffi.C_uint8, -1, false},
+		{ffi.C_int16, int16(-1), true},
+		{ffi.C_int16, 1 << 15, false},
+		{ffi.C_uint16, uint64(65535), true},
+		{ffi.C_uint16, 65536, false},
+		{ffi.C_int32, int64(-1) << 31, true},
+		{ffi.C_int32, int64(1) << 31, false},
+		{ffi.C_uint32, uint32(1<<32 - 1), true},
+		{ffi.C_uint32, uint64(1) << 32, false},
+		{ffi.C_int64, int64(math.MinInt64), true},
+		{ffi.C_int64, uint64(math.MaxUint64), false},
+		{ffi.C_uint64, uint64(math.MaxUint64), true},
+		{ffi.C_uint64, int8(-1), false},
+		{ffi.C_int32, 1.5, false},
+		{ffi.C_float, 3, true},
+		{ffi.C_float, 1.5, true},
+		{ffi.C_float, 1e300, false},
+		{ffi.C_float, math.Inf(-1), true},
+		{ffi.C_double, uint16(3), true},
+		{ffi.C_double, float32(-2.5), true},
+	} {
+		cif, err := ffi.NewCif(ffi.DefaultAbi, ffi.C_void, []ffi.Type{table.t})
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		var got interface{}
+		store, err := ffi.NewClosure(cif, func(v ffi.Value) {
+			switch v.Kind() {
+			case ffi.Float, ffi.Double:
+				got = v.Float()
+			case ffi.Uint8, ffi.Uint16, ffi.Uint32, ffi.Uint64:
+				got = v.Uint()
+			default:
+				got = v.Int()
+			}
+		})
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+
+		_, err = cif.Call(store.FctPtr(), table.arg)
+		store.Free()
+		if !table.ok {
+			if err == nil {
+				t.Errorf("failed to detect invalid conversion of [%T(%v)] to [%s]",
+					table.arg, table.arg, table.t.Name())
+			} else if _, ok := err.(*ffi.ArgumentError); !ok {
+				t.Errorf("expected a *ffi.ArgumentError, got [%T]", err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v", err)
+			continue
+		}
+		eq(t, fmt.Sprintf("%v", table.arg), fmt.Sprintf("%v", got))
+	}
+
+	// ffi.Values are passed as they are, when of the type of the argument
+	i16 := ffi.New(ffi.C_int16)
+	i16.SetInt(-3)
+	u32 := ffi.New(ffi.C_uint32)
+	u32.SetUint(1<<32 - 1)
+	f64 := ffi.New(ffi.C_double)
+	f64.SetFloat(2.5)
+	ld := ffi.New(ffi.C_longdouble)
+	ld.SetFloat(-0.5)
+	c128 := ffi.New(ffi.C_complex_double)
+	c128.SetComplex(1 + 2i)
+	for _, table := range []struct {
+		t   ffi.Type
+		arg ffi.Value
+		ok  bool
+	}{
+		{ffi.C_int16, i16, true},
+		{ffi.C_int32, i16, false},
+		{ffi.C_uint32, u32, true},
+		{ffi.C_int32, u32, false},
+		{ffi.C_double, f64, true},
+		{ffi.C_float, f64, false},
+		{ffi.C_longdouble, ld, true},
+		{ffi.C_double, ld, false},
+		{ffi.C_complex_double, c128, true},
+		{ffi.C_complex_float, c128, false},
+	} {
+		cif, err := ffi.NewCif(ffi.DefaultAbi, ffi.C_void, []ffi.Type{table.t})
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		var got string
+		store, err := ffi.NewClosure(cif, func(v ffi.Value) {
+			got = fmt.Sprintf("%v", v.GoValue())
+		})
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+
+		_, err = cif.Call(store.FctPtr(), table.arg)
+		store.Free()
+		if !table.ok {
+			if err == nil {
+				t.Errorf("failed to detect invalid ffi.Value of type [%s] for [%s]",
+					table.arg.Type().Name(), table.t.Name())
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v", err)
+			continue
+		}
+		eq(t, fmt.Sprintf("%v", table.arg.GoValue()), got)
+	}
+}
+
+func TestFFIErrno(t *testing.T) {
+	lib, err := ffi.NewLibrary(libc_name)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer lib.Close()
+
+	//int chdir(const char *path);
+	chdir, err := lib.FctErrno("chdir", ffi.C_int, []ffi.Type{ffi.C_pointer})
+	if err != nil {
+		t.Fatalf("could not locate function [chdir]: %v", err)
+	}
+	out, errno := chdir("/this/path/does/not/exist")
+	eq(t, int64(-1), out.Int())
+	eq(t, syscall.ENOENT, errno)
+
+	//long strtol(const char *nptr, char **endptr, int base);
+	strtol, err := lib.Func("strtol", ffi.C_long, []ffi.Type{ffi.C_pointer, ffi.C_pointer, ffi.C_int})
+	if err != nil {
+		t.Fatalf("could not locate function [strtol]: %v", err)
+	}
+	for _, table := range []struct {
+		str   string
+		errno syscall.Errno
+	}{
+		{"42", 0},
+		{"99999999999999999999999", syscall.ERANGE},
+		{"-42", 0},
+	} {
+		_, errno, err := strtol.CallErrno(table.str, nil, 10)
+		if err != nil {
+			t.Errorf("%v", err)
+		}
+		eq(t, table.errno, errno)
+	}
+}
+
+func TestCifCallResult(t *testing.T) {
+	for _, table := range []struct {
+		t   ffi.Type
+		val interface{}
+	}{
+		{ffi.C_uchar, uint64(255)},
+		{ffi.C_char, int64(-1)},
+		{ffi.C_ushort, uint64(65535)},
+		{ffi.C_short, int64(-2)},
+		{ffi.C_uint, uint64(1<<32 - 1)},
+		{ffi.C_int, int64(-3)},
+		{ffi.C_ulong, uint64(1<<63 + 1)},
+		{ffi.C_long, int64(-4)},
+		{ffi.C_uint8, uint64(200)},
+		{ffi.C_int8, int64(-128)},
+		{ffi.C_uint16, uint64(40000)},
+		{ffi.C_int16, int64(-32768)},
+		{ffi.C_uint32, uint64(1 << 31)},
+		{ffi.C_int32, int64(-1 << 31)},
+		{ffi.C_uint64, uint64(1<<64 - 1)},
+		{ffi.C_int64, int64(-1 << 63)},
+		{ffi.C_float, float64(-1.5)},
+		{ffi.C_double, float64(math.Pi)},
+	} {
+		cif, err := ffi.NewCif(ffi.DefaultAbi, table.t, nil)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		ret, err := ffi.NewClosure(cif, func() ffi.Value {
+			v := ffi.New(table.t)
+			switch val := table.val.(type) {
+			case int64:
+				v.SetInt(val)
+			case uint64:
+				v.SetUint(val)
+			case float64:
+				v.SetFloat(val)
+			}
+			return v
+		})
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+
+		out, err := cif.Call(ret.FctPtr())
+		ret.Free()
+		if err != nil {
+			t.Errorf("%v", err)
+			continue
+		}
+		eq(t, table.t, out.Type())
+		switch table.val.(type) {
+		case int64:
+			eq(t, table.val, out.Int())
+		case uint64:
+			eq(t, table.val, out.Uint())
+		case float64:
+			eq(t, table.val, out.Float())
+		}
+	}
+
+	// void
+	cif, err := ffi.NewCif(ffi.DefaultAbi, ffi.C_void, nil)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	ncalls := 0
+	noop, err := ffi.NewClosure(cif, func() { ncalls++ })
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer noop.Free()
+	out, err := cif.Call(noop.FctPtr())
+	if err != nil {
+		t.Errorf("%v", err)
+	}
+	eq(t, 1, ncalls)
+	eq(t, ffi.C_void, out.Type())
+	eq(t, ffi.Void, out.Kind())
+	eq(t, false, out.IsValid())
+
+	// pointer
+	lib, err := ffi.NewLibrary(libc_name)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer lib.Close()
+
+	//char *strchr(const char *s, int c);
+	strchr, err := lib.Func("strchr", ffi.C_pointer, []ffi.Type{ffi.C_pointer, ffi.C_int})
+	if err != nil {
+		t.Fatalf("could not locate function [strchr]: %v", err)
+	}
+	out, err = strchr.Call("foo", 'x')
+	if err != nil {
+		t.Errorf("%v", err)
+	}
+	eq(t, ffi.C_pointer, out.Type())
+	eq(t, true, out.IsNil())
+}
+
+func TestFFIComplex(t *testing.T) {
+	lib, err := ffi.NewLibrary(libm_name)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer lib.Close()
+
+	//double cabs(double complex z);
+	cabs, err := lib.Func("cabs", ffi.C_double, []ffi.Type{ffi.C_complex_double})
+	if err != nil {
+		t.Fatalf("could not locate function [cabs]: %v", err)
+	}
+	for _, arg := range []interface{}{complex(3, 4), complex64(complex(3, 4))} {
+		out, err := cabs.Call(arg)
+		if err != nil {
+			t.Errorf("%v", err)
+			continue
+		}
+		eq(t, 5.0, out.Float())
+	}
+	_, err = cabs.Call(complex(1e300, 0))
+	if err != nil {
+		t.Errorf("%v", err)
+	}
+
+	//double complex conj(double complex z);
+	conj, err := lib.Func("conj", ffi.C_complex_double, []ffi.Type{ffi.C_complex_double})
+	if err != nil {
+		t.Fatalf("could not locate function [conj]: %v", err)
+	}
+	out, err := conj.Call(complex(1, 2))
+	if err != nil {
+		t.Errorf("%v", err)
+	}
+	eq(t, ffi.C_complex_double, out.Type())
+	eq(t, complex(1, -2), out.Complex())
+
+	//float complex csqrtf(float complex z);
+	csqrtf, err := lib.Func("csqrtf", ffi.C_complex_float, []ffi.Type{ffi.C_complex_float})
+	if err != nil {
+		t.Fatalf("could not locate function [csqrtf]: %v", err)
+	}
+	out, err = csqrtf.Call(-4)
+	if err != nil {
+		t.Errorf("%v", err)
+	}
+	eq(t, complex(0, 2), out.Complex())
+
+	_, err = csqrtf.Call(complex(1e300, 0))
+	if err == nil {
+		t.Errorf("failed to detect overflow")
+	}
+
+	//float crealf(float complex z);
+	crealf, err := lib.Func("crealf", ffi.C_float, []ffi.Type{ffi.C_complex_float})
+	if err != nil {
+		t.Fatalf("could not locate function [crealf]: %v", err)
+	}
+	out, err = crealf.Call(complex64(complex(1.5, -1)))
+	if err != nil {
+		t.Errorf("%v", err)
+	}
+	eq(t, 1.5, out.Float())
+}
+
 // EOF
@@ -0,0 +1,146 @@
+package ffi
+
+// #include "ffi.h"
+import "C"
+
+import (
+	"fmt"
+)
+
+// NewFlexibleStructType creates a new ffi_type describing a C-struct whose
+// last member is a flexible array member of elements of type flex.Type,
+// such as 'struct rec { uint32_t len; uint8_t data[]; }'.
+// The flexible array member is not part of the struct: it has no element,
+// and values holding a given number of elements are created by NewFlexible
+// or Value.Flexible.
+// Such structs can not be passed by value, nor be members of other types.
+func NewFlexibleStructType(name string, fields []Field, flex Field) (Type, error) {
+	return g_types.NewFlexibleStructType(name, fields, flex)
+}
+
+// NewFlexibleStructType creates a new ffi_type describing a C-struct with
+// a flexible array member, declared in r.
+func (r *TypeRegistry) NewFlexibleStructType(name string, fields []Field, flex Field) (Type, error) {
+	const fct = "ffi.NewFlexibleStructType"
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("%s: struct [%s] has no member besides its flexible array member", fct, name)
+	}
+	if is_incomplete(flex.Type) || is_flexible(flex.Type) {
+		return nil, fmt.Errorf("%s: invalid flexible array member type [%s]", fct, flex.Type.Name())
+	}
+	at, err := NewArrayType(0, flex.Type)
+	if err != nil {
+		return nil, err
+	}
+	all := make([]Field, 0, len(fields)+1)
+	all = append(all, fields...)
+	all = append(all, Field{flex.Name, at})
+	return new_struct_type(r, fct, name, all, StructLayout{}, true)
+}
+
+// is_flexible returns whether t is a struct with a flexible array member,
+// or the array type of such a member sized by with_len.
+func is_flexible(t Type) bool {
+	switch t := t.(type) {
+	case *cffi_struct:
+		t.rlock()
+		defer t.runlock()
+		return t.flexible
+	case *cffi_array:
+		return t.flexible
+	}
+	return false
+}
+
+// flexible_base returns the flexible struct t is an instance of, or t.
+func flexible_base(t Type) Type {
+	if st, ok := t.(*cffi_struct); ok && st.base != nil {
+		return st.base
+	}
+	return t
+}
+
+// with_len returns the type of the values of the flexible struct t holding
+// n elements in their flexible array member.
+// Its size is the one of the struct, or the one of its members and of
+// the n elements, rounded up to the alignment of the struct.
+func (t *cffi_struct) with_len(n int) (*cffi_struct, error) {
+	if t.base != nil {
+		t = t.base
+	}
+	last := len(t.fields) - 1
+	at, err := flexible_array(n, t.fields[last].Type.Elem())
+	if err != nil {
+		return nil, err
+	}
+	c := *t.cptr()
+	size := align_up(t.fields[last].Offset+at.Size(), uintptr(t.Align()))
+	if size > t.Size() {
+		c.size = C.size_t(size)
+	}
+	st := *t
+	st.cffi_type.c = &c
+	st.fields = append([]StructField(nil), t.fields...)
+	st.fields[last].Type = at
+	st.base = t
+	return &st, nil
+}
+
+// flexible_array returns the type of a flexible array member of n elements
+// of type elmt.
+// The type is neither registered nor described element-wise to libffi, as
+// flexible array members are never passed by value: creating it costs the
+// same whatever n.
+func flexible_array(n int, elmt Type) (*cffi_array, error) {
+	if n < 0 {
+		return nil, fmt.Errorf("ffi: negative length (%d) of flexible array member", n)
+	}
+	if sz := elmt.Size(); sz != 0 && uintptr(n) > ^uintptr(0)/sz {
+		return nil, fmt.Errorf("ffi: flexible array member of %d [%s] overflows", n, elmt.Name())
+	}
+	c := C.ffi_type{}
+	c._type = C.FFI_TYPE_STRUCT
+	c.size = C.size_t(uintptr(n) * elmt.Size())
+	c.alignment = C.ushort(elmt.Align())
+	t := &cffi_array{
+		cffi_type: cffi_type{n: array_name(elmt, fmt.Sprintf("[%d]", n)), c: &c},
+		len:       n,
+		elem:      elmt,
+		flexible:  true,
+	}
+	return t, nil
+}
+
+// NewFlexible returns a Value representing a pointer to a new zero value
+// for the specified struct type, with n elements in its flexible array
+// member.
+// It panics if typ is not a struct with a flexible array member.
+func NewFlexible(typ Type, n int) Value {
+	if typ.Kind() != Struct || !is_flexible(typ) {
+		panic("ffi: NewFlexible of type [" + typ.Name() + "] without flexible array member")
+	}
+	st, err := typ.(*cffi_struct).with_len(n)
+	if err != nil {
+		panic("ffi: NewFlexible: " + err.Error())
+	}
+	return New(st)
+}
+
+// Flexible returns v, a struct with a flexible array member, as holding n
+// elements in its flexible array member.
+// The memory of v must hold these n elements, as when v was allocated by C
+// code knowing the number of elements of the flexible array member.
+// It panics if v's type is not a struct with a flexible array member.
+func (v Value) Flexible(n int) Value {
+	v.mustBe(Struct)
+	if !is_flexible(v.typ) {
+		panic("ffi: Flexible of type [" + v.typ.Name() + "] without flexible array member")
+	}
+	st, err := v.typ.(*cffi_struct).with_len(n)
+	if err != nil {
+		panic("ffi: Flexible: " + err.Error())
+	}
+	return Value{st, v.val}
+}
+
+// EOF
@@ -0,0 +1,169 @@
+package ffi
+
+// #include "ffi.h"
+// typedef void (*_go_ffi_fctptr_t)(void);
+import "C"
+
+import (
+	"fmt"
+	"strings"
+	"unsafe"
+)
+
+// cffi_function describes a C function pointer type.
+// It shares the ffi_type of C_pointer.
+type cffi_function struct {
+	cffi_type
+	rtype    Type
+	args     []Type
+	variadic bool
+
+	cif  *Cif      // call interface of non-variadic functions
+	vars *var_cifs // call interfaces of variadic functions
+
+	reg *TypeRegistry // registry the function type is declared in
+}
+
+func (t *cffi_function) Kind() Kind {
+	return FuncPtr
+}
+
+func (t *cffi_function) NumIn() int {
+	return len(t.args)
+}
+
+func (t *cffi_function) In(i int) Type {
+	if i < 0 || i >= len(t.args) {
+		panic("ffi: argument index out of range")
+	}
+	return t.args[i]
+}
+
+func (t *cffi_function) Out() Type {
+	return t.rtype
+}
+
+func (t *cffi_function) IsVariadic() bool {
+	return t.variadic
+}
+
+// NewFunctionType creates a new ffi_type describing a pointer to a C
+// function returning rtype and taking args.
+// If variadic is true, args are the fixed arguments of the function.
+// Values of a function type can be called with Value.Call and set to a Go
+// function with Value.SetFunc.
+func NewFunctionType(rtype Type, args []Type, variadic bool) (Type, error) {
+	n := function_name(rtype, args, variadic)
+	r := registry_of(rtype)
+	for _, arg := range args {
+		if r != g_types {
+			break
+		}
+		r = registry_of(arg)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if t := r.type_by_name(n); t != nil {
+		// check the definitions are the same
+		ft, ok := t.(*cffi_function)
+		if !ok || ft.rtype != rtype || ft.variadic != variadic || len(ft.args) != len(args) {
+			return nil, fmt.Errorf("ffi.NewFunctionType: inconsistent re-declaration of [%s]", n)
+		}
+		for i := range args {
+			if ft.args[i] != args[i] {
+				return nil, fmt.Errorf("ffi.NewFunctionType: inconsistent re-declaration of [%s] (argument #%d type mismatch)", n, i)
+			}
+		}
+		return t, nil
+	}
+
+	t := &cffi_function{
+		cffi_type: cffi_type{n: n, c: C_pointer.cptr()},
+		rtype:     rtype,
+		args:      append([]Type(nil), args...),
+		variadic:  variadic,
+		reg:       r,
+	}
+	if variadic {
+		if err := check_cif_types(rtype, args); err != nil {
+			return nil, fmt.Errorf("ffi.NewFunctionType: %v", err)
+		}
+		t.vars = new_var_cifs(rtype, t.args)
+	} else {
+		cif, err := NewCif(DefaultAbi, rtype, t.args)
+		if err != nil {
+			return nil, fmt.Errorf("ffi.NewFunctionType: %v", err)
+		}
+		t.cif = cif
+	}
+	r.register(t)
+	return t, nil
+}
+
+// function_name returns the C name of a function pointer type
+func function_name(rtype Type, args []Type, variadic bool) string {
+	names := make([]string, 0, len(args)+1)
+	for _, arg := range args {
+		names = append(names, arg.Name())
+	}
+	if variadic {
+		names = append(names, "...")
+	}
+	if len(names) == 0 {
+		names = append(names, "void")
+	}
+	return rtype.Name() + "(*)(" + strings.Join(names, ", ") + ")"
+}
+
+// FctPtr returns the function pointer held by v.
+// It panics if v's Kind is not FuncPtr.
+func (v Value) FctPtr() FctPtr {
+	v.mustBe(FuncPtr)
+	return FctPtr{*(*C._go_ffi_fctptr_t)(v.val)}
+}
+
+// SetFctPtr sets the function pointer held by v to fct.
+// It panics if v's Kind is not FuncPtr.
+func (v Value) SetFctPtr(fct FctPtr) {
+	v.mustBe(FuncPtr)
+	*(*C._go_ffi_fctptr_t)(v.val) = fct.c
+}
+
+// Call calls the C function pointed at by v with the provided arguments,
+// as Cif.Call does.
+// The arguments following the fixed ones of a variadic function are
+// converted to C types following the C default argument promotions.
+// It panics if v's Kind is not FuncPtr.
+func (v Value) Call(args ...interface{}) (Value, error) {
+	v.mustBe(FuncPtr)
+	if *(*unsafe.Pointer)(v.val) == nil {
+		return Value{}, fmt.Errorf("ffi.Value.Call: call of nil function pointer of type [%s]", v.typ.Name())
+	}
+	t := v.typ.(*cffi_function)
+	if t.variadic {
+		out, _, err := t.vars.call(v.FctPtr(), false, args)
+		return out, err
+	}
+	return t.cif.Call(v.FctPtr(), args...)
+}
+
+// SetFunc sets the function pointer held by v to a closure calling the Go
+// function fct, as created by NewClosure.
+// The returned closure must be kept alive for as long as C code may call
+// it, and freed afterwards.
+// It panics if v's Kind is not FuncPtr.
+func (v Value) SetFunc(fct interface{}) (*Closure, error) {
+	v.mustBe(FuncPtr)
+	t := v.typ.(*cffi_function)
+	if t.variadic {
+		return nil, fmt.Errorf("ffi.Value.SetFunc: can not create a closure of variadic function type [%s]", t.Name())
+	}
+	c, err := NewClosure(t.cif, fct)
+	if err != nil {
+		return nil, err
+	}
+	v.SetFctPtr(c.FctPtr())
+	return c, nil
+}
+
+// EOF
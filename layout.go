@@ -0,0 +1,205 @@
+package ffi
+
+// #include "ffi.h"
+import "C"
+
+import (
+	"fmt"
+)
+
+// StructLayout describes how the fields of a struct are laid out, when
+// this differs from the natural alignment rules.
+type StructLayout struct {
+	// Pack is the maximum alignment of the fields, as set by
+	// '#pragma pack(Pack)'. A Pack of 1 describes an
+	// '__attribute__((packed))' struct.
+	// Within packed structs, whatever the value of Pack, bitfields start
+	// at the next available bit, even when straddling the units of the
+	// alignment of their type, as they do with GCC.
+	// 0 means no packing.
+	Pack int
+
+	// Align is the minimum alignment of the struct, as set by
+	// '__attribute__((aligned(Align)))'. 0 means the natural alignment.
+	Align int
+
+	// FieldAlign holds the minimum alignment of each field, as set by
+	// 'alignas(N)' on a field declaration. 0 means the natural alignment.
+	// FieldAlign is either nil or holds one entry per field.
+	FieldAlign []int
+}
+
+// NewStructTypeLayout creates a new ffi_type describing a C-struct with
+// the given layout.
+// Structs whose fields are not at their natural offset (such as packed
+// structs) can not be described to libffi, and thus can not be passed
+// by value to, or returned from, a function: NewCif fails with such types.
+func NewStructTypeLayout(name string, fields []Field, layout StructLayout) (Type, error) {
+	return g_types.NewStructTypeLayout(name, fields, layout)
+}
+
+// check returns an error if l is not a valid layout for n fields
+func (l StructLayout) check(n int) error {
+	if !is_alignment(l.Pack) {
+		return fmt.Errorf("invalid pack value (%d)", l.Pack)
+	}
+	if !is_alignment(l.Align) {
+		return fmt.Errorf("invalid alignment (%d)", l.Align)
+	}
+	if l.FieldAlign != nil && len(l.FieldAlign) != n {
+		return fmt.Errorf("invalid number of field alignments (%d, expected %d)", len(l.FieldAlign), n)
+	}
+	for i, a := range l.FieldAlign {
+		if !is_alignment(a) {
+			return fmt.Errorf("invalid alignment (%d) for field #%d", a, i)
+		}
+	}
+	return nil
+}
+
+// is_alignment returns whether a is 0 or a power of 2
+func is_alignment(a int) bool {
+	return a >= 0 && a&(a-1) == 0
+}
+
+func (l StructLayout) equal(o StructLayout) bool {
+	if l.Pack != o.Pack || l.Align != o.Align {
+		return false
+	}
+	for i := 0; i < len(l.FieldAlign) || i < len(o.FieldAlign); i++ {
+		if l.field_align(i) != o.field_align(i) {
+			return false
+		}
+	}
+	return true
+}
+
+// field_align returns the minimum alignment of the i'th field
+func (l StructLayout) field_align(i int) int {
+	if i < len(l.FieldAlign) {
+		return l.FieldAlign[i]
+	}
+	return 0
+}
+
+// natural returns whether the given fields laid out with l are laid out
+// following the natural alignment rules, which libffi implements.
+// libffi can not lay out empty structs, nor zero-sized members such as
+// zero-length arrays.
+func (l StructLayout) natural(fields []Field) bool {
+	if l.Pack != 0 || l.Align != 0 || len(fields) == 0 {
+		return false
+	}
+	for i, f := range fields {
+		if l.field_align(i) != 0 || is_bitfield(f.Type) || f.Type.Size() == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// layout_struct lays out the struct t holding the given fields, following
+// the System V (GCC) rules:
+// a bitfield is allocated at the next available bit, unless it would then
+// span more units of the alignment of its type than the type itself, in
+// which case it starts at the next such unit. A long long bitfield thus
+// spans two 4-byte units where long long is 4-byte aligned (as on i386),
+// and a single 8-byte unit where it is 8-byte aligned.
+// Packed structs have no such units.
+//
+// The elements of the libffi struct are the regular fields of the struct,
+// with the bytes holding bitfields described as uint8 elements. Zero-sized
+// fields hold no bytes, and are left out.
+func layout_struct(t *cffi_struct, fields []Field) {
+	l := t.layout
+	var (
+		bit   uintptr // next available bit
+		align = 1
+	)
+	for i, f := range fields {
+		sz := 8 * f.Type.Size()
+		fa := f.Type.Align()
+		if l.field_align(i) > fa {
+			fa = l.field_align(i)
+		}
+		if l.Pack != 0 && fa > l.Pack {
+			fa = l.Pack
+		}
+		a := 8 * uintptr(fa)
+
+		t.fields[i] = StructField{Name: f.Name, Type: f.Type}
+		bf, ok := f.Type.(*cffi_bitfield)
+		switch {
+		case !ok:
+			bit = align_up(bit, a)
+			t.fields[i].Offset = bit / 8
+			bit += sz
+		case bf.bits == 0:
+			// unnamed bitfields do not contribute to the struct alignment
+			bit = align_up(bit, a)
+			t.fields[i].Offset = bit / 8
+			continue
+		default:
+			bits := uintptr(bf.bits)
+			if l.field_align(i) != 0 || (l.Pack == 0 && excess_unit_span(bit, bits, sz, a)) {
+				bit = align_up(bit, a)
+			}
+			t.fields[i].Offset = bit / 8
+			t.fields[i].BitOffset = int(bit % 8)
+			t.fields[i].Bits = bf.bits
+			bit += bits
+		}
+		if fa > align {
+			align = fa
+		}
+	}
+	if l.Align > align {
+		align = l.Align
+	}
+	size := align_up(bit, 8*uintptr(align)) / 8
+
+	cargs := make([]*C.ffi_type, 0, len(fields)+1)
+	off := uintptr(0)
+	for i, f := range t.fields {
+		switch {
+		case t.flexible && i == len(t.fields)-1:
+			// the flexible array member is not part of the struct
+		case f.Type.Size() == 0 && !is_bitfield(f.Type):
+		case !is_bitfield(f.Type):
+			if align_up(off, uintptr(f.Type.Align())) != f.Offset {
+				t.irregular = true
+			}
+			cargs = append(cargs, f.Type.cptr())
+			off = f.Offset + f.Type.Size()
+		case f.Bits > 0:
+			end := (8*f.Offset + uintptr(f.BitOffset+f.Bits) + 7) / 8
+			for ; off < end; off++ {
+				cargs = append(cargs, C_uint8.cptr())
+			}
+		}
+	}
+	cargs = append(cargs, nil)
+
+	// libffi only lays out aggregates with a zero size: set our own layout.
+	c := t.cptr()
+	c.size = C.size_t(size)
+	c.alignment = C.ushort(align)
+	c.elements = &cargs[0]
+}
+
+// excess_unit_span returns whether a bitfield of the given width, allocated
+// at bit, spans more units of a bits, the alignment of its type, than its
+// type of sz bits itself.
+func excess_unit_span(bit, bits, sz, a uintptr) bool {
+	return (bit%a+bits+a-1)/a > sz/a
+}
+
+// align_up rounds x up to a multiple of a
+func align_up(x, a uintptr) uintptr {
+	if r := x % a; r != 0 {
+		x += a - r
+	}
+	return x
+}
+
+// EOF
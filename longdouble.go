@@ -0,0 +1,269 @@
+package ffi
+
+// #include <float.h>
+// #define _GO_FFI_SIZEOF_LONGDOUBLE sizeof(long double)
+import "C"
+
+import (
+	"encoding/binary"
+	"math"
+	"math/big"
+	"reflect"
+)
+
+// CLongDouble holds a C long double value, in the format and byte order
+// of long double for GOARCH: the 80-bit x87 extended precision format
+// (padded to 12 or 16 bytes) on 386 and amd64, the 128-bit IEEE-754
+// quadruple precision format (as on arm64 linux or s390x) or, where long
+// double is just a double, the 64-bit IEEE-754 double precision format.
+// Other formats (such as the IBM double-double one) are not supported.
+type CLongDouble struct {
+	b [C._GO_FFI_SIZEOF_LONGDOUBLE]byte
+}
+
+// the long double formats
+const (
+	ldbl_double = 53  // IEEE-754 double precision
+	ldbl_x87    = 64  // x87 extended precision
+	ldbl_quad   = 113 // IEEE-754 quadruple precision
+)
+
+// ldbl_mant_dig is the number of bits of the long double mantissa,
+// identifying the format of long double on this platform.
+const ldbl_mant_dig = C.LDBL_MANT_DIG
+
+const ldbl_bias = 16383
+
+// ldbl_order is the byte order of long double values, the one of GOARCH
+var ldbl_order = binary.NativeEndian
+
+// ldbl_big_endian is whether the most significant 64-bit word of quadruple
+// precision values comes first
+var ldbl_big_endian = ldbl_order.Uint16([]byte{0, 1}) == 1
+
+var g_longdouble_type = reflect.TypeOf(CLongDouble{})
+
+// NewCLongDouble returns the long double value closest to x.
+// The conversion is exact, except on platforms where long double is
+// less precise than float64.
+func NewCLongDouble(x float64) CLongDouble {
+	if ldbl_mant_dig == ldbl_double {
+		var ld CLongDouble
+		ldbl_order.PutUint64(ld.b[:], math.Float64bits(x))
+		return ld
+	}
+	if math.IsNaN(x) {
+		return ldbl_nan(math.Signbit(x))
+	}
+	return CLongDoubleFromBig(big.NewFloat(x))
+}
+
+// CLongDoubleFromBig returns the long double value closest to f.
+func CLongDoubleFromBig(f *big.Float) CLongDouble {
+	var ld CLongDouble
+	switch ldbl_mant_dig {
+	case ldbl_double:
+		x, _ := f.Float64()
+		ldbl_order.PutUint64(ld.b[:], math.Float64bits(x))
+		return ld
+	}
+
+	var exp uint64
+	mant := new(big.Int)
+	switch {
+	case f.IsInf():
+		exp = 0x7fff
+	case f.Sign() == 0:
+		// ok.
+	default:
+		a := new(big.Float).Abs(f)
+		if e := a.MantExp(nil) - 1 + ldbl_bias; e <= 0 {
+			// denormal: a is mant * 2^(1-bias-(ldbl_mant_dig-1))
+			a.SetMantExp(a, ldbl_bias-1+ldbl_mant_dig-1)
+			mant = round_even(a)
+			if mant.BitLen() == ldbl_mant_dig {
+				// rounded up to the smallest normal value
+				exp = 1
+			}
+		} else {
+			// rounded to nearest even
+			g := new(big.Float).SetPrec(ldbl_mant_dig).Set(a)
+			e := g.MantExp(g) // g is now in [0.5, 1)
+			g.SetMantExp(g, ldbl_mant_dig)
+			g.Int(mant)
+			e = e - 1 + ldbl_bias
+			if e >= 0x7fff {
+				// overflow: +/-Inf
+				exp = 0x7fff
+				mant.SetInt64(0)
+			} else {
+				exp = uint64(e)
+			}
+		}
+		if ldbl_mant_dig == ldbl_quad {
+			// implicit integer bit
+			mant.SetBit(mant, ldbl_mant_dig-1, 0)
+		}
+	}
+	if f.Signbit() {
+		exp |= 0x8000
+	}
+	if exp&0x7fff == 0x7fff && ldbl_mant_dig == ldbl_x87 {
+		// explicit integer bit of infinities
+		mant.SetBit(mant, ldbl_x87-1, 1)
+	}
+	ld.set(mant, exp)
+	return ld
+}
+
+// round_even returns the integer nearest to the non-negative value x,
+// rounding halfway cases to even.
+func round_even(x *big.Float) *big.Int {
+	r, _ := x.Rat(nil)
+	q, m := new(big.Int).QuoRem(r.Num(), r.Denom(), new(big.Int))
+	m.Lsh(m, 1)
+	if c := m.Cmp(r.Denom()); c > 0 || (c == 0 && q.Bit(0) == 1) {
+		q.Add(q, big.NewInt(1))
+	}
+	return q
+}
+
+// ldbl_nan returns a quiet NaN long double value
+func ldbl_nan(neg bool) CLongDouble {
+	var ld CLongDouble
+	exp := uint64(0x7fff)
+	if neg {
+		exp |= 0x8000
+	}
+	mant := new(big.Int)
+	switch ldbl_mant_dig {
+	case ldbl_double:
+		ldbl_order.PutUint64(ld.b[:], math.Float64bits(math.NaN()))
+		return ld
+	case ldbl_x87:
+		mant.SetUint64(3 << 62)
+	case ldbl_quad:
+		mant.SetBit(mant, ldbl_quad-2, 1)
+	}
+	ld.set(mant, exp)
+	return ld
+}
+
+// set stores the (raw) mantissa and the sign+exponent bits into ld.
+func (ld *CLongDouble) set(mant *big.Int, exp uint64) {
+	b := ld.b[:]
+	switch ldbl_mant_dig {
+	case ldbl_x87:
+		ldbl_order.PutUint64(b[0:8], mant.Uint64())
+		ldbl_order.PutUint16(b[8:10], uint16(exp))
+	case ldbl_quad:
+		lo := new(big.Int).And(mant, new(big.Int).SetUint64(math.MaxUint64))
+		hi := new(big.Int).Rsh(mant, 64)
+		blo, bhi := quad_words(b)
+		ldbl_order.PutUint64(blo, lo.Uint64())
+		ldbl_order.PutUint64(bhi, hi.Uint64()|exp<<48)
+	}
+}
+
+// get returns the (raw) mantissa and the sign+exponent bits of ld.
+func (ld CLongDouble) get() (*big.Int, uint64) {
+	b := ld.b[:]
+	mant := new(big.Int)
+	switch ldbl_mant_dig {
+	case ldbl_x87:
+		mant.SetUint64(ldbl_order.Uint64(b[0:8]))
+		return mant, uint64(ldbl_order.Uint16(b[8:10]))
+	case ldbl_quad:
+		blo, bhi := quad_words(b)
+		hi := ldbl_order.Uint64(bhi)
+		mant.SetUint64(hi & (1<<48 - 1))
+		mant.Lsh(mant, 64)
+		mant.Or(mant, new(big.Int).SetUint64(ldbl_order.Uint64(blo)))
+		return mant, hi >> 48
+	}
+	panic("unreachable")
+}
+
+// quad_words returns the low and high 64-bit words of the quadruple
+// precision value b.
+func quad_words(b []byte) (lo, hi []byte) {
+	if ldbl_big_endian {
+		return b[8:16], b[0:8]
+	}
+	return b[0:8], b[8:16]
+}
+
+// IsNaN reports whether ld is a "not-a-number" value.
+func (ld CLongDouble) IsNaN() bool {
+	if ldbl_mant_dig == ldbl_double {
+		return math.IsNaN(ld.Float64())
+	}
+	mant, exp := ld.get()
+	if exp&0x7fff != 0x7fff {
+		return false
+	}
+	if ldbl_mant_dig == ldbl_x87 {
+		mant.SetBit(mant, ldbl_x87-1, 0)
+	}
+	return mant.Sign() != 0
+}
+
+// Float64 returns the float64 value nearest to ld.
+func (ld CLongDouble) Float64() float64 {
+	if ldbl_mant_dig == ldbl_double {
+		return math.Float64frombits(ldbl_order.Uint64(ld.b[:]))
+	}
+	if ld.IsNaN() {
+		return math.NaN()
+	}
+	x, _ := ld.BigFloat().Float64()
+	return x
+}
+
+// BigFloat returns the exact value of ld as a big.Float.
+// It returns nil if ld is a NaN.
+func (ld CLongDouble) BigFloat() *big.Float {
+	if ldbl_mant_dig == ldbl_double {
+		x := ld.Float64()
+		if math.IsNaN(x) {
+			return nil
+		}
+		return big.NewFloat(x)
+	}
+	if ld.IsNaN() {
+		return nil
+	}
+	mant, exp := ld.get()
+	neg := exp&0x8000 != 0
+	exp &= 0x7fff
+
+	f := new(big.Float).SetPrec(ldbl_mant_dig)
+	switch {
+	case exp == 0x7fff:
+		f.SetInf(neg)
+		return f
+	case exp == 0:
+		// zero or denormal
+		exp = 1
+	case ldbl_mant_dig == ldbl_quad:
+		// implicit integer bit
+		mant.SetBit(mant, ldbl_quad-1, 1)
+	}
+	f.SetInt(mant)
+	f.SetMantExp(f, int(exp)-ldbl_bias-(ldbl_mant_dig-1))
+	if neg {
+		f.Neg(f)
+	}
+	return f
+}
+
+// String returns a string representation of ld.
+func (ld CLongDouble) String() string {
+	f := ld.BigFloat()
+	if f == nil {
+		return "NaN"
+	}
+	return f.Text('g', -1)
+}
+
+// EOF
@@ -0,0 +1,153 @@
+package ffi_test
+
+import (
+	"math"
+	"math/big"
+	"testing"
+
+	ffi "github.com/sbinet/go-ffi"
+)
+
+func TestCLongDouble(t *testing.T) {
+	for _, x := range []float64{
+		0, 1, -1, 0.5, -2.25, math.Pi, 1e300, -1e-300,
+		math.MaxFloat64, math.SmallestNonzeroFloat64,
+		math.Inf(1), math.Inf(-1),
+	} {
+		ld := ffi.NewCLongDouble(x)
+		eq(t, x, ld.Float64())
+		if f := ld.BigFloat(); f == nil || f.Cmp(big.NewFloat(x)) != 0 {
+			t.Errorf("expected [%v], got [%v]", x, f)
+		}
+	}
+
+	nan := ffi.NewCLongDouble(math.NaN())
+	eq(t, true, nan.IsNaN())
+	eq(t, true, math.IsNaN(nan.Float64()))
+	if nan.BigFloat() != nil {
+		t.Errorf("expected a nil big.Float for NaN")
+	}
+
+	// 1 + 2^-60 is not representable as a float64
+	one := new(big.Float).SetPrec(128).SetInt64(1)
+	x := new(big.Float).SetPrec(128).SetMantExp(one, -60)
+	x.Add(x, one)
+	ld := ffi.CLongDoubleFromBig(x)
+	eq(t, 1.0, ld.Float64())
+	if ffi.C_longdouble.Size() > ffi.C_double.Size() && ld.BigFloat().Cmp(x) != 0 {
+		t.Errorf("expected [%v], got [%v]", x.Text('g', 30), ld.BigFloat().Text('g', 30))
+	}
+}
+
+func TestCLongDoubleDenormal(t *testing.T) {
+	prec := int(ffi.NewCLongDouble(1).BigFloat().Prec())
+	if ffi.C_longdouble.Size() == ffi.C_double.Size() {
+		prec = 53
+	}
+	// smallest denormal value, 2^emin
+	emin := -1021 - 53
+	if prec > 53 {
+		emin = 1 - 16383 - (prec - 1)
+	}
+	denorm := func(m float64) *big.Float {
+		f := new(big.Float).SetPrec(256).SetFloat64(m)
+		return f.SetMantExp(f, emin)
+	}
+	for _, table := range []struct {
+		x, want *big.Float
+	}{
+		// halfway cases are rounded to even
+		{denorm(0.5), denorm(0)},
+		{denorm(1.5), denorm(2)},
+		{denorm(2.5), denorm(2)},
+		{denorm(-2.5), denorm(-2)},
+		{denorm(0.75), denorm(1)},
+		{denorm(0.25), denorm(0)},
+		{denorm(3.25), denorm(3)},
+		// rounded up to the smallest normal value
+		{
+			new(big.Float).Sub(denorm(math.Ldexp(1, prec-1)), denorm(0.5)),
+			denorm(math.Ldexp(1, prec-1)),
+		},
+		{
+			new(big.Float).Sub(denorm(math.Ldexp(1, prec-1)), denorm(0.25)),
+			denorm(math.Ldexp(1, prec-1)),
+		},
+		{
+			new(big.Float).Sub(denorm(math.Ldexp(1, prec-1)), denorm(1.5)),
+			new(big.Float).Sub(denorm(math.Ldexp(1, prec-1)), denorm(2)),
+		},
+	} {
+		got := ffi.CLongDoubleFromBig(table.x).BigFloat()
+		if got.Cmp(table.want) != 0 {
+			t.Errorf("%v: expected [%v], got [%v]",
+				table.x.Text('g', 20), table.want.Text('g', 20), got.Text('g', 20))
+		}
+	}
+}
+
+func TestLongDoubleValue(t *testing.T) {
+	eq(t, "long double", ffi.C_longdouble.Name())
+	eq(t, ffi.C_longdouble, ffi.TypeOf(ffi.CLongDouble{}))
+
+	cval := ffi.New(ffi.C_longdouble)
+	eq(t, 0.0, cval.Float())
+	cval.SetFloat(-66)
+	eq(t, -66.0, cval.Float())
+	eq(t, ffi.NewCLongDouble(-66), cval.CLongDouble())
+	eq(t, ffi.NewCLongDouble(-66), cval.GoValue().Interface())
+
+	cval = ffi.ValueOf(ffi.NewCLongDouble(42))
+	eq(t, ffi.C_longdouble, cval.Type())
+	eq(t, 42.0, cval.Float())
+
+	ctyp, err := ffi.NewStructType("struct_ldbl", []ffi.Field{
+		{"F1", ffi.C_char},
+		{"F2", ffi.C_longdouble},
+	})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	eq(t, uintptr(ffi.C_longdouble.Align()), ctyp.Field(1).Offset)
+	cval = ffi.New(ctyp)
+	cval.Field(1).SetFloat(math.E)
+	eq(t, math.E, cval.Field(1).Float())
+}
+
+func TestFFILongDouble(t *testing.T) {
+	lib, err := ffi.NewLibrary(libm_name)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer lib.Close()
+
+	//long double sqrtl(long double x);
+	sqrtl, err := lib.Func("sqrtl", ffi.C_longdouble, []ffi.Type{ffi.C_longdouble})
+	if err != nil {
+		t.Fatalf("could not locate function [sqrtl]: %v", err)
+	}
+
+	for _, arg := range []interface{}{
+		2,
+		2.0,
+		ffi.NewCLongDouble(2),
+		big.NewFloat(2),
+	} {
+		out, err := sqrtl.Call(arg)
+		if err != nil {
+			t.Errorf("%v", err)
+			continue
+		}
+		eq(t, ffi.C_longdouble, out.Type())
+		eq(t, math.Sqrt2, out.Float())
+
+		got := out.CLongDouble().BigFloat()
+		ref := new(big.Float).SetPrec(got.Prec()).SetInt64(2)
+		ref.Sqrt(ref)
+		if got.Cmp(ref) != 0 {
+			t.Errorf("expected [%v], got [%v]", ref.Text('g', 40), got.Text('g', 40))
+		}
+	}
+}
+
+// EOF
@@ -0,0 +1,126 @@
+package ffi
+
+// #include "ffi.h"
+import "C"
+
+import (
+	"fmt"
+	"sync"
+)
+
+// NewOpaqueType declares a C struct without defining it, as does
+// 'struct name;' in C.
+// Such an incomplete type can only be used behind pointers, for example to
+// describe handles like 'sqlite3*' or 'FILE*', which are then distinct from
+// 'void*'. It can later be completed with NewStructType.
+func NewOpaqueType(name string) (Type, error) {
+	return g_types.NewOpaqueType(name)
+}
+
+// NewOpaqueType declares a C struct without defining it, in r.
+func (r *TypeRegistry) NewOpaqueType(name string) (Type, error) {
+	t, _, err := r.declare_opaque(name)
+	return t, err
+}
+
+// declare_opaque declares a C struct without defining it, in r.
+// It also returns whether the struct was declared by this call.
+func (r *TypeRegistry) declare_opaque(name string) (Type, bool, error) {
+	if name == "" {
+		return nil, false, fmt.Errorf("ffi.NewOpaqueType: opaque types must be named")
+	}
+	if err := r.check_name(name); err != nil {
+		return nil, false, fmt.Errorf("ffi.NewOpaqueType: %v", err)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if t := r.type_by_name(name); t != nil {
+		// a defined struct may be declared again
+		if _, ok := t.(*cffi_struct); !ok {
+			return nil, false, fmt.Errorf("ffi.NewOpaqueType: inconsistent re-declaration of [%s]", name)
+		}
+		return t, false, nil
+	}
+	c := C.ffi_type{}
+	c._type = C.FFI_TYPE_STRUCT
+	t := &cffi_struct{
+		cffi_type:  cffi_type{n: name, c: &c},
+		incomplete: true,
+		mu:         new(sync.RWMutex),
+		reg:        r,
+	}
+	r.register(t)
+	return t, true, nil
+}
+
+// undeclare removes the struct decl, declared but never defined, from r
+// along with the types derived from it.
+func (r *TypeRegistry) undeclare(decl Type) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.type_by_name(decl.Name()) != decl || !is_incomplete(decl) {
+		return
+	}
+	for n, t := range r.types {
+		if derives_from(t, decl) {
+			delete(r.types, n)
+		}
+	}
+}
+
+// derives_from returns whether t is decl, or an array, pointer or slice
+// type of elements deriving from decl
+func derives_from(t, decl Type) bool {
+	for t != decl {
+		switch t.(type) {
+		case *cffi_array, *cffi_ptr, *cffi_slice:
+			t = t.Elem()
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// is_incomplete returns whether t is a declared but not yet defined struct
+func is_incomplete(t Type) bool {
+	st, ok := t.(*cffi_struct)
+	if !ok {
+		return false
+	}
+	st.rlock()
+	defer st.runlock()
+	return st.incomplete
+}
+
+// complete defines the declared struct t as def.
+// The definition is copied while holding the lock of t, so that concurrent
+// readers of t see it either incomplete or fully defined.
+func (t *cffi_struct) complete(def *cffi_struct) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.fields = def.fields
+	t.layout = def.layout
+	t.irregular = def.irregular
+	t.flexible = def.flexible
+	t.c.size = def.c.size
+	t.c.alignment = def.c.alignment
+	t.c.elements = def.c.elements
+	t.incomplete = false
+}
+
+// rlock locks t for reading, if t may be completed concurrently
+func (t *cffi_struct) rlock() {
+	if t.mu != nil {
+		t.mu.RLock()
+	}
+}
+
+// runlock undoes a call to rlock
+func (t *cffi_struct) runlock() {
+	if t.mu != nil {
+		t.mu.RUnlock()
+	}
+}
+
+// EOF
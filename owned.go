@@ -0,0 +1,84 @@
+package ffi
+
+import (
+	"runtime"
+	"sync"
+	"unsafe"
+)
+
+// owned is a resource owned by the memory of a Value, such as a C string
+// stored by SetString.
+type owned struct {
+	slot    uintptr // address of the memory owning the resource
+	release func()
+	once    sync.Once
+	cleanup runtime.Cleanup
+}
+
+// free releases the resource o, once.
+func (o *owned) free() {
+	o.once.Do(o.release)
+}
+
+// g_owned holds the resources owned by the memory of values, by the address
+// of that memory.
+// Addresses are stored as uintptr, for the memory to be garbage collected.
+var g_owned = struct {
+	sync.Mutex
+	m map[uintptr]*owned
+}{m: make(map[uintptr]*owned)}
+
+// own hands the resource released by release over to the memory at slot,
+// releasing the resource slot previously owned.
+// The resource is released when slot owns another resource or, if slot
+// is Go memory, once that memory has been garbage collected.
+func own(slot unsafe.Pointer, release func()) {
+	o := &owned{slot: uintptr(slot), release: release}
+	o.cleanup = add_cleanup(slot, o)
+	g_owned.Lock()
+	old := g_owned.m[o.slot]
+	g_owned.m[o.slot] = o
+	g_owned.Unlock()
+	if old != nil {
+		old.cleanup.Stop()
+		old.free()
+	}
+}
+
+// disown releases the resource owned by the memory at slot, if any.
+func disown(slot unsafe.Pointer) {
+	g_owned.Lock()
+	o := g_owned.m[uintptr(slot)]
+	delete(g_owned.m, uintptr(slot))
+	g_owned.Unlock()
+	if o != nil {
+		o.cleanup.Stop()
+		o.free()
+	}
+}
+
+// add_cleanup arranges for o to be released once the Go memory at slot has
+// been garbage collected.
+// Memory outside of the Go heap, such as C memory, is never collected.
+func add_cleanup(slot unsafe.Pointer, o *owned) (c runtime.Cleanup) {
+	defer func() {
+		if recover() != nil {
+			c = runtime.Cleanup{}
+		}
+	}()
+	return runtime.AddCleanup((*byte)(slot), release_owned, o)
+}
+
+// release_owned releases o, the memory owning it having been collected.
+// The memory may have been reused by another value in the meantime, in
+// which case the resource it owns is left untouched.
+func release_owned(o *owned) {
+	g_owned.Lock()
+	if g_owned.m[o.slot] == o {
+		delete(g_owned.m, o.slot)
+	}
+	g_owned.Unlock()
+	o.free()
+}
+
+// EOF
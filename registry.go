@@ -0,0 +1,132 @@
+package ffi
+
+import (
+	"fmt"
+	"sync"
+)
+
+// TypeRegistry is a namespace of named types.
+// Types declared in distinct registries do not collide: two libraries may
+// each declare a 'struct config' with different fields in their own registry.
+// Lookups in a registry fall back on the default registry, which holds the
+// builtin types and the types declared with the package-level functions.
+//
+// Array, pointer and slice types are registered in the registry of their
+// element type, bitfield types in the one of their underlying type, and
+// function types in the first registry other than the default one of their
+// return and argument types. Builtin types, such as "int", can not be
+// redeclared.
+//
+// The types derived from Go types (by TypeOf, ValueOf, encoders and
+// decoders) are declared in the default registry, and the types named by
+// 'ffi' struct tags are looked up in the default registry.
+//
+// A TypeRegistry is safe for concurrent use.
+type TypeRegistry struct {
+	// types are looked up and created while holding mu, so that
+	// concurrent creations of the same type yield the same ffi.Type.
+	mu     sync.RWMutex
+	types  map[string]Type
+	parent *TypeRegistry
+}
+
+// the default registry of types
+var g_types = &TypeRegistry{types: make(map[string]Type)}
+
+// g_builtins holds the names of the builtin types
+var g_builtins = make(map[string]bool)
+
+// NewTypeRegistry creates a new, empty, registry of types.
+func NewTypeRegistry() *TypeRegistry {
+	return &TypeRegistry{
+		types:  make(map[string]Type),
+		parent: g_types,
+	}
+}
+
+// TypeByName returns a ffi.Type by name.
+// Returns nil if no such type exists
+func TypeByName(n string) Type {
+	return g_types.TypeByName(n)
+}
+
+// TypeByName returns the ffi.Type named n in the registry r, or in the
+// default registry.
+// Returns nil if no such type exists
+func (r *TypeRegistry) TypeByName(n string) Type {
+	r.mu.RLock()
+	t, ok := r.types[n]
+	r.mu.RUnlock()
+	if ok {
+		return t
+	}
+	if r.parent != nil {
+		return r.parent.TypeByName(n)
+	}
+	return nil
+}
+
+// type_by_name returns the ffi.Type named n declared in r, or nil.
+// r must be locked.
+func (r *TypeRegistry) type_by_name(n string) Type {
+	t, ok := r.types[n]
+	if ok {
+		return t
+	}
+	return nil
+}
+
+// check_name returns an error if a type named n can not be declared in r:
+// builtin types can not be shadowed by the types of other registries.
+func (r *TypeRegistry) check_name(n string) error {
+	if r != g_types && g_builtins[n] {
+		return fmt.Errorf("[%s] is a builtin type", n)
+	}
+	return nil
+}
+
+// register registers t in r.
+// r must be locked.
+func (r *TypeRegistry) register(t Type) {
+	r.types[t.Name()] = t
+}
+
+// NewStructType creates a new ffi_type describing a C-struct, declared in r.
+func (r *TypeRegistry) NewStructType(name string, fields []Field) (Type, error) {
+	return new_struct_type(r, "ffi.NewStructType", name, fields, StructLayout{}, false)
+}
+
+// NewStructTypeLayout creates a new ffi_type describing a C-struct with the
+// given layout, declared in r.
+func (r *TypeRegistry) NewStructTypeLayout(name string, fields []Field, layout StructLayout) (Type, error) {
+	return new_struct_type(r, "ffi.NewStructTypeLayout", name, fields, layout, false)
+}
+
+// registry_of returns the registry holding the types derived from t
+func registry_of(t Type) *TypeRegistry {
+	switch t := t.(type) {
+	case *cffi_struct:
+		if t.reg != nil {
+			return t.reg
+		}
+	case *cffi_union:
+		if t.reg != nil {
+			return t.reg
+		}
+	case *cffi_enum:
+		if t.reg != nil {
+			return t.reg
+		}
+	case *cffi_function:
+		if t.reg != nil {
+			return t.reg
+		}
+	case *cffi_bitfield:
+		return registry_of(t.base)
+	case *cffi_array, *cffi_ptr, *cffi_slice:
+		return registry_of(t.Elem())
+	}
+	return g_types
+}
+
+// EOF
@@ -0,0 +1,162 @@
+package ffi
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// field_tag describes the mapping of a go struct field to a C struct field,
+// as set by its 'ffi' struct tag:
+//
+//	ffi:"name=x_pos,type=short,pack=1,skip"
+//
+// name is the name of the C field, which defaults to the go field name.
+// type is the name of the C type of the field, such as "long" or
+// "char[16]", which defaults to the type derived from the go type.
+// pack packs the whole struct, as '#pragma pack(N)'.
+// skip omits the go field from the C struct.
+type field_tag struct {
+	name  string
+	ctype string
+	pack  int
+	skip  bool
+}
+
+// parse_field_tag returns the ffi tag of the go struct field f
+func parse_field_tag(f reflect.StructField) (field_tag, error) {
+	tag := field_tag{name: f.Name}
+	s, ok := f.Tag.Lookup("ffi")
+	if !ok {
+		return tag, nil
+	}
+	for _, opt := range strings.Split(s, ",") {
+		opt = strings.TrimSpace(opt)
+		key, val := opt, ""
+		if i := strings.Index(opt, "="); i >= 0 {
+			key, val = opt[:i], opt[i+1:]
+		}
+		switch key {
+		case "":
+		case "name":
+			if val == "" {
+				return tag, fmt.Errorf("empty name in tag of field [%s]", f.Name)
+			}
+			tag.name = val
+		case "type":
+			if val == "" {
+				return tag, fmt.Errorf("empty type in tag of field [%s]", f.Name)
+			}
+			tag.ctype = val
+		case "pack":
+			n, err := strconv.Atoi(val)
+			if err != nil || n <= 0 || !is_alignment(n) {
+				return tag, fmt.Errorf("invalid pack value [%s] in tag of field [%s]", val, f.Name)
+			}
+			tag.pack = n
+		case "skip":
+			tag.skip = true
+		default:
+			return tag, fmt.Errorf("invalid option [%s] in tag of field [%s]", opt, f.Name)
+		}
+	}
+	return tag, nil
+}
+
+// c_field_index returns, for each field of the go struct rt, the index of
+// the C field it is mapped to, or -1 if it is skipped.
+func c_field_index(rt reflect.Type) []int {
+	idx := make([]int, rt.NumField())
+	n := 0
+	for i := range idx {
+		tag, err := parse_field_tag(rt.Field(i))
+		if err != nil {
+			panic("ffi: " + err.Error())
+		}
+		if tag.skip {
+			idx[i] = -1
+			continue
+		}
+		idx[i] = n
+		n++
+	}
+	return idx
+}
+
+// ctype_by_name returns the type named n, which may be a pointer or an
+// array of a named type, such as "char*" or "char[4][16]".
+// Named types are looked up in the default registry.
+func ctype_by_name(n string) (Type, error) {
+	n = strings.TrimSpace(n)
+	if t := TypeByName(n); t != nil {
+		return t, nil
+	}
+	if i := strings.Index(n, "["); i > 0 && strings.HasSuffix(n, "]") {
+		et, err := ctype_by_name(n[:i])
+		if err != nil {
+			return nil, err
+		}
+		dims := strings.Split(n[i+1:len(n)-1], "][")
+		for j := len(dims) - 1; j >= 0; j-- {
+			sz, err := strconv.Atoi(strings.TrimSpace(dims[j]))
+			if err != nil || sz < 0 {
+				return nil, fmt.Errorf("invalid array type [%s]", n)
+			}
+			et, err = NewArrayType(sz, et)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return et, nil
+	}
+	if strings.HasSuffix(n, "*") {
+		et, err := ctype_by_name(n[:len(n)-1])
+		if err != nil {
+			return nil, err
+		}
+		return NewPointerType(et)
+	}
+	return nil, fmt.Errorf("unknown type [%s]", n)
+}
+
+// check_tag_type returns an error if values of the go type rt can not be
+// stored into values of the C type ct, named in the tag of a field.
+func check_tag_type(ct Type, rt reflect.Type) error {
+	ck := ct.Kind()
+	ok := false
+	switch rt.Kind() {
+	case reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Uintptr:
+		ok = is_signed(ck) || is_unsigned(ck)
+	case reflect.UnsafePointer:
+		ok = ck == Ptr
+	case reflect.Float32, reflect.Float64:
+		ok = ck == Float || ck == Double
+	case reflect.String:
+		ok = ck == String || is_char_array(ct)
+	case reflect.Array:
+		ok = ck == Array && ct.Len() == rt.Len() &&
+			check_tag_type(ct.Elem(), rt.Elem()) == nil
+	default:
+		ok = is_compatible(ct, ctype_from_gotype(rt))
+	}
+	if !ok {
+		return fmt.Errorf("go type [%s] can not be stored as [%s]", rt, ct.Name())
+	}
+	return nil
+}
+
+// is_char_array returns whether t is an array of bytes, holding a
+// NUL-terminated string
+func is_char_array(t Type) bool {
+	if t.Kind() != Array {
+		return false
+	}
+	k := t.Elem().Kind()
+	return (k == Int8 || k == Uint8) && t.Elem().Size() == 1
+}
+
+// EOF
@@ -3,9 +3,16 @@ package ffi
 import (
 	"fmt"
 	"reflect"
+	"strconv"
+	"sync"
 	"unsafe"
 )
 
+// #include <stdbool.h>
+// #include <stddef.h>
+// #include <stdint.h>
+// #include <sys/types.h>
+// #include <wchar.h>
 // #include "ffi.h"
 // static void _go_ffi_type_set_type(ffi_type *t, unsigned short type)
 // {
@@ -68,10 +75,13 @@ const (
 	Int64      Kind = C.FFI_TYPE_SINT64
 	Struct     Kind = C.FFI_TYPE_STRUCT
 	Ptr        Kind = C.FFI_TYPE_POINTER
+	Complex    Kind = C.FFI_TYPE_COMPLEX
 	//FIXME
 	Array Kind = 255 + iota
 	Slice
 	String
+	Union
+	FuncPtr
 )
 
 func (k Kind) String() string {
@@ -106,12 +116,18 @@ func (k Kind) String() string {
 		return "Struct"
 	case Ptr:
 		return "Ptr"
+	case Complex:
+		return "Complex"
 	case Array:
 		return "Array"
 	case Slice:
 		return "Slice"
 	case String:
 		return "String"
+	case Union:
+		return "Union"
+	case FuncPtr:
+		return "FuncPtr"
 	}
 	panic("unreachable")
 }
@@ -144,15 +160,32 @@ type Type interface {
 	// It panics if the type's Kind is not Array or Ptr
 	Elem() Type
 
-	// Field returns a struct type's i'th field.
-	// It panics if the type's Kind is not Struct.
+	// Field returns a struct or union type's i'th field.
+	// It panics if the type's Kind is not Struct or Union.
 	// It panics if i is not in the range [0, NumField()).
 	Field(i int) StructField
 
-	// NumField returns a struct type's field count.
-	// It panics if the type's Kind is not Struct.
+	// NumField returns a struct or union type's field count.
+	// It panics if the type's Kind is not Struct or Union.
 	NumField() int
 
+	// NumIn returns a function type's fixed arguments count.
+	// It panics if the type's Kind is not FuncPtr.
+	NumIn() int
+
+	// In returns the type of a function type's i'th argument.
+	// It panics if the type's Kind is not FuncPtr.
+	// It panics if i is not in the range [0, NumIn()).
+	In(i int) Type
+
+	// Out returns a function type's return type.
+	// It panics if the type's Kind is not FuncPtr.
+	Out() Type
+
+	// IsVariadic reports whether a function type is variadic.
+	// It panics if the type's Kind is not FuncPtr.
+	IsVariadic() bool
+
 	// GoType returns the reflect.Type this ffi.Type is mirroring
 	// It returns nil if there is no such equivalent go type.
 	GoType() reflect.Type
@@ -206,8 +239,8 @@ func (t *cffi_type) Elem() Type {
 		tt := (*cffi_array)(unsafe.Pointer(&t))
 		return tt.Elem()
 	case Ptr:
-		tt := (*cffi_ptr)(unsafe.Pointer(&t))
-		return tt.Elem()
+		// C_pointer is an untyped pointer: void*
+		return C_void
 	case Slice:
 		tt := (*cffi_slice)(unsafe.Pointer(&t))
 		return tt.Elem()
@@ -231,24 +264,47 @@ func (t *cffi_type) Field(i int) StructField {
 	return tt.Field(i)
 }
 
+func (t *cffi_type) NumIn() int {
+	panic("ffi: NumIn of non-func type")
+}
+
+func (t *cffi_type) In(i int) Type {
+	panic("ffi: In of non-func type")
+}
+
+func (t *cffi_type) Out() Type {
+	panic("ffi: Out of non-func type")
+}
+
+func (t *cffi_type) IsVariadic() bool {
+	panic("ffi: IsVariadic of non-func type")
+}
+
 func (t *cffi_type) GoType() reflect.Type {
+	g_gotypes.RLock()
+	defer g_gotypes.RUnlock()
 	return t.rt
 }
 
 func (t *cffi_type) set_gotype(rt reflect.Type) {
+	g_gotypes.Lock()
+	defer g_gotypes.Unlock()
 	t.rt = rt
 }
 
+// g_gotypes protects the associations b/w ffi.Types and reflect.Types
+var g_gotypes sync.RWMutex
+
 var (
 	C_void       Type = &cffi_type{"void", &C.ffi_type_void, nil}
 	C_uchar           = &cffi_type{"unsigned char", &C.ffi_type_uchar, reflect.TypeOf(uint8(0))}
 	C_char            = &cffi_type{"char", &C.ffi_type_schar, reflect.TypeOf(int8(0))}
 	C_ushort          = &cffi_type{"unsigned short", &C.ffi_type_ushort, reflect.TypeOf(uint16(0))}
 	C_short           = &cffi_type{"short", &C.ffi_type_sshort, reflect.TypeOf(int16(0))}
-	C_uint            = &cffi_type{"unsigned int", &C.ffi_type_uint, reflect.TypeOf(uint(0))}
-	C_int             = &cffi_type{"int", &C.ffi_type_sint, reflect.TypeOf(int(0))}
-	C_ulong           = &cffi_type{"unsigned long", &C.ffi_type_ulong, reflect.TypeOf(uint64(0))}
-	C_long            = &cffi_type{"long", &C.ffi_type_slong, reflect.TypeOf(int64(0))}
+	C_uint            = &cffi_type{"unsigned int", &C.ffi_type_uint, int_gotype(C.sizeof_uint, false)}
+	C_int             = &cffi_type{"int", &C.ffi_type_sint, int_gotype(C.sizeof_int, true)}
+	C_ulong           = &cffi_type{"unsigned long", &C.ffi_type_ulong, int_gotype(C.sizeof_ulong, false)}
+	C_long            = &cffi_type{"long", &C.ffi_type_slong, int_gotype(C.sizeof_long, true)}
 	C_uint8           = &cffi_type{"uint8", &C.ffi_type_uint8, reflect.TypeOf(uint8(0))}
 	C_int8            = &cffi_type{"int8", &C.ffi_type_sint8, reflect.TypeOf(int8(0))}
 	C_uint16          = &cffi_type{"uint16", &C.ffi_type_uint16, reflect.TypeOf(uint16(0))}
@@ -259,34 +315,160 @@ var (
 	C_int64           = &cffi_type{"int64", &C.ffi_type_sint64, reflect.TypeOf(int64(0))}
 	C_float           = &cffi_type{"float", &C.ffi_type_float, reflect.TypeOf(float32(0.))}
 	C_double          = &cffi_type{"double", &C.ffi_type_double, reflect.TypeOf(float64(0.))}
-	C_longdouble      = &cffi_type{"long double", &C.ffi_type_longdouble, nil}
-	C_pointer         = &cffi_type{"*", &C.ffi_type_pointer, reflect.TypeOf(nil)}
+	C_longdouble      = &cffi_type{"long double", &C.ffi_type_longdouble, reflect.TypeOf(CLongDouble{})}
+	C_pointer         = &cffi_type{"*", &C.ffi_type_pointer, reflect.TypeOf(unsafe.Pointer(nil))}
+)
+
+// typedefs of the C library, whose size depends on the platform data model
+var (
+	C_size_t    Type = new_int_type("size_t", C.sizeof_size_t, false)
+	C_ssize_t        = new_int_type("ssize_t", C.sizeof_ssize_t, true)
+	C_intptr_t       = new_int_type("intptr_t", C.sizeof_intptr_t, true)
+	C_uintptr_t      = &cffi_type{"uintptr_t", int_ctype(C.sizeof_uintptr_t, false), reflect.TypeOf(uintptr(0))}
+	C_ptrdiff_t      = new_int_type("ptrdiff_t", C.sizeof_ptrdiff_t, true)
+	C_bool           = &cffi_type{"_Bool", int_ctype(C.sizeof__Bool, false), reflect.TypeOf(false)}
+	C_wchar_t        = new_int_type("wchar_t", C.sizeof_wchar_t, g_wchar_signed)
+	C_off_t          = new_int_type("off_t", C.sizeof_off_t, true)
 )
 
+// g_wchar_signed is true when wchar_t is a signed type
+var g_wchar_signed = func() bool {
+	x := C.wchar_t(0)
+	x--
+	return x < 0
+}()
+
+// new_int_type returns a builtin integer type of n bytes
+func new_int_type(name string, n uintptr, signed bool) *cffi_type {
+	return &cffi_type{name, int_ctype(n, signed), int_gotype(n, signed)}
+}
+
+// int_ctype returns the libffi integer type of n bytes
+func int_ctype(n uintptr, signed bool) *C.ffi_type {
+	switch n {
+	case 1:
+		if signed {
+			return &C.ffi_type_sint8
+		}
+		return &C.ffi_type_uint8
+	case 2:
+		if signed {
+			return &C.ffi_type_sint16
+		}
+		return &C.ffi_type_uint16
+	case 4:
+		if signed {
+			return &C.ffi_type_sint32
+		}
+		return &C.ffi_type_uint32
+	case 8:
+		if signed {
+			return &C.ffi_type_sint64
+		}
+		return &C.ffi_type_uint64
+	}
+	panic(fmt.Sprintf("ffi: no integer type of size %d", n))
+}
+
+// int_gotype returns the Go integer type of n bytes
+func int_gotype(n uintptr, signed bool) reflect.Type {
+	switch n {
+	case 1:
+		if signed {
+			return reflect.TypeOf(int8(0))
+		}
+		return reflect.TypeOf(uint8(0))
+	case 2:
+		if signed {
+			return reflect.TypeOf(int16(0))
+		}
+		return reflect.TypeOf(uint16(0))
+	case 4:
+		if signed {
+			return reflect.TypeOf(int32(0))
+		}
+		return reflect.TypeOf(uint32(0))
+	case 8:
+		if signed {
+			return reflect.TypeOf(int64(0))
+		}
+		return reflect.TypeOf(uint64(0))
+	}
+	panic(fmt.Sprintf("ffi: no integer type of size %d", n))
+}
+
 type StructField struct {
 	Name   string  // Name is the field name
 	Type   Type    // field type
 	Offset uintptr // offset within struct, in bytes
+
+	// bitfields start at bit BitOffset of the byte at Offset.
+	// Bits are allocated from the least significant bit of a byte on
+	// little-endian platforms, from the most significant one on big-endian.
+	BitOffset int // offset of the bitfield within the byte at Offset, in bits
+	Bits      int // width of the bitfield, in bits. 0 if not a bitfield
 }
 
 type cffi_struct struct {
 	cffi_type
 	fields []StructField
+	layout StructLayout
+
+	// irregular is true when the layout of the struct can not be
+	// described to libffi, which then can not pass it by value.
+	irregular bool
+
+	// incomplete is true for declared but not yet defined structs.
+	// mu guards the completion of the structs declared by NewOpaqueType,
+	// and is nil for the others.
+	incomplete bool
+	mu         *sync.RWMutex
+
+	// flexible is true when the last field is a flexible array member.
+	// base is the flexible struct a struct with a given number of
+	// elements in its flexible array member is an instance of.
+	flexible bool
+	base     *cffi_struct
+
+	reg *TypeRegistry // registry the struct is declared in
+}
+
+func (t *cffi_struct) Size() uintptr {
+	t.rlock()
+	defer t.runlock()
+	return t.cffi_type.Size()
+}
+
+func (t *cffi_struct) Align() int {
+	t.rlock()
+	defer t.runlock()
+	return t.cffi_type.Align()
 }
 
 func (t *cffi_struct) NumField() int {
+	t.rlock()
+	defer t.runlock()
 	return len(t.fields)
 }
 
 func (t *cffi_struct) Field(i int) StructField {
+	t.rlock()
+	defer t.runlock()
 	if i < 0 || i >= len(t.fields) {
 		panic("ffi: field index out of range")
 	}
 	return t.fields[i]
 }
 
+// is_irregular returns whether libffi can not describe the layout of t
+func (t *cffi_struct) is_irregular() bool {
+	t.rlock()
+	defer t.runlock()
+	return t.irregular
+}
+
 func (t *cffi_struct) set_gotype(rt reflect.Type) {
-	t.cffi_type.rt = rt
+	t.cffi_type.set_gotype(rt)
 }
 
 type Field struct {
@@ -296,39 +478,90 @@ type Field struct {
 
 var g_id_ch chan int
 
-// NewStructType creates a new ffi_type describing a C-struct
+// NewStructType creates a new ffi_type describing a C-struct.
+// Bitfields are declared with fields of a type created by NewBitfieldType.
+// If the struct was declared by NewOpaqueType, it is completed in place.
 func NewStructType(name string, fields []Field) (Type, error) {
+	return g_types.NewStructType(name, fields)
+}
+
+func new_struct_type(r *TypeRegistry, fct, name string, fields []Field, layout StructLayout, flexible bool) (Type, error) {
 	if name == "" {
 		// anonymous type...
 		// generate some id.
 		name = fmt.Sprintf("_ffi_anon_type_%d", <-g_id_ch)
 	}
-	if t := TypeByName(name); t != nil {
+	if err := r.check_name(name); err != nil {
+		return nil, fmt.Errorf("%s: %v", fct, err)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	old := r.type_by_name(name)
+	var decl *cffi_struct
+	if is_incomplete(old) {
+		if len(fields) == 0 {
+			return old, nil
+		}
+		decl = old.(*cffi_struct)
+		old = nil
+	}
+	if t := old; t != nil {
 		// check the definitions are the same
 		if t.NumField() != len(fields) {
-			return nil, fmt.Errorf("ffi.NewStructType: inconsistent re-declaration of [%s]", name)
+			return nil, fmt.Errorf("%s: inconsistent re-declaration of [%s]", fct, name)
 		}
 		for i := range fields {
 			if fields[i].Name != t.Field(i).Name {
-				return nil, fmt.Errorf("ffi.NewStructType: inconsistent re-declaration of [%s] (field #%d name mismatch)", name, i)
+				return nil, fmt.Errorf("%s: inconsistent re-declaration of [%s] (field #%d name mismatch)", fct, name, i)
 
 			}
 			if fields[i].Type != t.Field(i).Type {
-				return nil, fmt.Errorf("ffi.NewStructType: inconsistent re-declaration of [%s] (field #%d type mismatch)", name, i)
+				return nil, fmt.Errorf("%s: inconsistent re-declaration of [%s] (field #%d type mismatch)", fct, name, i)
 
 			}
 		}
+		if st, ok := t.(*cffi_struct); ok && !st.layout.equal(layout) {
+			return nil, fmt.Errorf("%s: inconsistent re-declaration of [%s] (layout mismatch)", fct, name)
+		}
+		if is_flexible(t) != flexible {
+			return nil, fmt.Errorf("%s: inconsistent re-declaration of [%s] (flexible array member mismatch)", fct, name)
+		}
 		return t, nil
 	}
-	c := C.ffi_type{}
+	if err := layout.check(len(fields)); err != nil {
+		return nil, fmt.Errorf("%s: %v", fct, err)
+	}
+	for i, f := range fields {
+		if is_incomplete(f.Type) {
+			return nil, fmt.Errorf("%s: field #%d of [%s] has incomplete type [%s]", fct, i, name, f.Type.Name())
+		}
+		if is_flexible(f.Type) {
+			return nil, fmt.Errorf("%s: field #%d of [%s] has a flexible array member", fct, i, name)
+		}
+	}
 	t := &cffi_struct{
-		cffi_type: cffi_type{n: name, c: &c},
-		fields:    make([]StructField, len(fields)),
+		cffi_type: cffi_type{n: name, c: &C.ffi_type{}},
+		reg:       r,
 	}
+	t.fields = make([]StructField, len(fields))
+	t.layout = layout
+	t.flexible = flexible
 	t.cffi_type.c.size = 0
 	t.cffi_type.c.alignment = 0
 	C._go_ffi_type_set_type(t.cptr(), C.FFI_TYPE_STRUCT)
 
+	if flexible || !layout.natural(fields) {
+		layout_struct(t, fields)
+		if t.Size() != 0 {
+			// libffi can not lay out zero-sized structs
+			err := layout_type(t)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return register_struct(r, decl, t), nil
+	}
+
 	var c_fields **C.ffi_type = nil
 	if len(fields) > 0 {
 		var cargs = make([]*C.ffi_type, len(fields)+1)
@@ -341,7 +574,7 @@ func NewStructType(name string, fields []Field) (Type, error) {
 	C._go_ffi_type_set_elements(t.cptr(), unsafe.Pointer(c_fields))
 
 	// initialize type (computes alignment and size)
-	_, err := NewCif(DefaultAbi, t, nil)
+	err := layout_type(t)
 	if err != nil {
 		return nil, err
 	}
@@ -350,19 +583,33 @@ func NewStructType(name string, fields []Field) (Type, error) {
 		//cft := C._go_ffi_type_get_element(t.cptr(), C.int(i))
 		ff := fields[i]
 		t.fields[i] = StructField{
-			ff.Name,
-			TypeByName(ff.Type.Name()),
-			uintptr(C._go_ffi_type_get_offsetof(t.cptr(), C.int(i))),
+			Name:   ff.Name,
+			Type:   ff.Type,
+			Offset: uintptr(C._go_ffi_type_get_offsetof(t.cptr(), C.int(i))),
 		}
 	}
-	register_type(t)
-	return t, nil
+	return register_struct(r, decl, t), nil
+}
+
+// register_struct registers the struct type t in r and returns it.
+// If the struct was declared by NewOpaqueType, the declaration decl is
+// completed with t instead, and returned.
+func register_struct(r *TypeRegistry, decl, t *cffi_struct) Type {
+	if decl != nil {
+		decl.complete(t)
+		t = decl
+	}
+	r.register(t)
+	return t
 }
 
 type cffi_array struct {
 	cffi_type
 	len  int
 	elem Type
+
+	// flexible is true for the flexible array members sized by with_len
+	flexible bool
 }
 
 func (t *cffi_array) Kind() Kind {
@@ -379,10 +626,28 @@ func (t *cffi_array) Elem() Type {
 	return t.elem
 }
 
+func (t *cffi_array) GoType() reflect.Type {
+	if rt := t.cffi_type.GoType(); rt != nil {
+		return rt
+	}
+	if et := t.elem.GoType(); et != nil {
+		return reflect.ArrayOf(t.len, et)
+	}
+	return nil
+}
+
 // NewArrayType creates a new ffi_type with the given size and element type.
+// Multi-dimensional arrays are arrays of arrays: 'float m[4][3]' is an
+// array of 4 elements of type 'float[3]'.
 func NewArrayType(sz int, elmt Type) (Type, error) {
-	n := fmt.Sprintf("%s[%d]", elmt.Name(), sz)
-	if t := TypeByName(n); t != nil {
+	if sz < 0 {
+		return nil, fmt.Errorf("ffi.NewArrayType: negative length (%d)", sz)
+	}
+	n := array_name(elmt, fmt.Sprintf("[%d]", sz))
+	r := registry_of(elmt)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if t := r.type_by_name(n); t != nil {
 		return t, nil
 	}
 	c := C.ffi_type{}
@@ -391,22 +656,57 @@ func NewArrayType(sz int, elmt Type) (Type, error) {
 		len:       sz,
 		elem:      elmt,
 	}
-	t.cffi_type.c.size = C.size_t(sz * int(elmt.Size()))
-	t.cffi_type.c.alignment = C_pointer.c.alignment
-	var c_fields **C.ffi_type = nil
-	C._go_ffi_type_set_elements(t.cptr(), unsafe.Pointer(c_fields))
-	C._go_ffi_type_set_type(t.cptr(), C.FFI_TYPE_POINTER)
+	if is_incomplete(elmt) {
+		return nil, fmt.Errorf("ffi.NewArrayType: incomplete element type [%s]", elmt.Name())
+	}
+	if is_flexible(elmt) {
+		return nil, fmt.Errorf("ffi.NewArrayType: element type [%s] has a flexible array member", elmt.Name())
+	}
+	// libffi has no concept of array: describe it as a struct holding sz
+	// elements of type elmt.
+	C._go_ffi_type_set_type(t.cptr(), C.FFI_TYPE_STRUCT)
+	if sz == 0 {
+		// libffi can not lay out empty structs
+		t.cffi_type.c.size = 0
+		t.cffi_type.c.alignment = C.ushort(elmt.Align())
+		r.register(t)
+		return t, nil
+	}
+	t.cffi_type.c.size = 0
+	t.cffi_type.c.alignment = 0
+	var cargs = make([]*C.ffi_type, sz+1)
+	for i := 0; i < sz; i++ {
+		cargs[i] = elmt.cptr()
+	}
+	cargs[sz] = nil
+	C._go_ffi_type_set_elements(t.cptr(), unsafe.Pointer(&cargs[0]))
 
 	// initialize type (computes alignment and size)
-	_, err := NewCif(DefaultAbi, t, nil)
+	err := layout_type(t)
 	if err != nil {
 		return nil, err
 	}
 
-	register_type(t)
+	r.register(t)
 	return t, nil
 }
 
+// array_name returns the C name of an array of elmt, of dimension dim.
+// The dimensions of an array of arrays are listed from the outermost one:
+// an array of 4 'float[3]' is a 'float[4][3]'.
+func array_name(elmt Type, dim string) string {
+	dims := ""
+	for {
+		at, ok := elmt.(*cffi_array)
+		if !ok {
+			break
+		}
+		dims += fmt.Sprintf("[%d]", at.len)
+		elmt = at.elem
+	}
+	return elmt.Name() + dim + dims
+}
+
 type cffi_ptr struct {
 	cffi_type
 	elem Type
@@ -416,10 +716,25 @@ func (t *cffi_ptr) Elem() Type {
 	return t.elem
 }
 
+func (t *cffi_ptr) GoType() reflect.Type {
+	if rt := t.cffi_type.GoType(); rt != nil {
+		return rt
+	}
+	// the element type may have been completed after the pointer type
+	if et := t.elem.GoType(); et != nil {
+		return reflect.PtrTo(et)
+	}
+	return nil
+}
+
 // NewPointerType creates a new ffi_type with the given element type
 func NewPointerType(elmt Type) (Type, error) {
+	elmt = flexible_base(elmt)
 	n := elmt.Name() + "*"
-	if t := TypeByName(n); t != nil {
+	r := registry_of(elmt)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if t := r.type_by_name(n); t != nil {
 		return t, nil
 	}
 	c := C.ffi_type{}
@@ -427,9 +742,6 @@ func NewPointerType(elmt Type) (Type, error) {
 		cffi_type: cffi_type{n: n, c: &c},
 		elem:      elmt,
 	}
-	if elmt.GoType() != nil {
-		t.cffi_type.rt = reflect.PtrTo(elmt.GoType())
-	}
 	t.cffi_type.c.size = C_pointer.c.size
 	t.cffi_type.c.alignment = C_pointer.c.alignment
 	var c_fields **C.ffi_type = nil
@@ -437,12 +749,12 @@ func NewPointerType(elmt Type) (Type, error) {
 	C._go_ffi_type_set_type(t.cptr(), C.FFI_TYPE_POINTER)
 
 	// initialize type (computes alignment and size)
-	_, err := NewCif(DefaultAbi, t, nil)
+	err := layout_type(t)
 	if err != nil {
 		return nil, err
 	}
 
-	register_type(t)
+	r.register(t)
 	return t, nil
 }
 
@@ -464,7 +776,10 @@ func (t *cffi_slice) Elem() Type {
 // NewSliceType creates a new ffi_type slice with the given element type
 func NewSliceType(elmt Type) (Type, error) {
 	n := elmt.Name() + "[]"
-	if t := TypeByName(n); t != nil {
+	r := registry_of(elmt)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if t := r.type_by_name(n); t != nil {
 		return t, nil
 	}
 	c := C.ffi_type{}
@@ -494,38 +809,69 @@ func NewSliceType(elmt Type) (Type, error) {
 	C._go_ffi_type_set_elements(t.cptr(), unsafe.Pointer(c_fields))
 
 	// initialize type (computes alignment and size)
-	_, err := NewCif(DefaultAbi, t, nil)
+	err := layout_type(t)
 	if err != nil {
 		return nil, err
 	}
 
-	register_type(t)
+	r.register(t)
 	return t, nil
 }
 
-// the global map of types
-var g_types map[string]Type
+// g_go_int is the c-type as wide as go's int
+var g_go_int = func() Type {
+	if strconv.IntSize == 64 {
+		return C_int64
+	}
+	return C_int32
+}()
 
-// TypeByName returns a ffi.Type by name.
-// Returns nil if no such type exists
-func TypeByName(n string) Type {
-	t, ok := g_types[n]
-	if ok {
-		return t
+// g_go_uint is the c-type as wide as go's uint
+var g_go_uint = func() Type {
+	if strconv.IntSize == 64 {
+		return C_uint64
 	}
-	return nil
+	return C_uint32
+}()
+
+// ctype_from_gotype returns the ffi type of values of the go type rt.
+// Struct types are declared in the default registry.
+func ctype_from_gotype(rt reflect.Type) Type {
+	return ctype_from_gotype_rec(rt, make(map[reflect.Type]*gostruct_decl))
 }
 
-func register_type(t Type) {
-	g_types[t.Name()] = t
+// gostruct_decl is the forward declaration of a go struct type being built
+type gostruct_decl struct {
+	t       Type // declared type, nil until the struct refers to itself
+	created bool // whether t was declared by declare
 }
 
-func ctype_from_gotype(rt reflect.Type) Type {
+// declare declares the struct type rt, being built, for the pointers to
+// rt within rt to refer to it.
+func (d *gostruct_decl) declare(rt reflect.Type) {
+	t, created, err := g_types.declare_opaque(rt.Name())
+	if err != nil {
+		panic("ffi: " + err.Error())
+	}
+	d.t = t
+	d.created = created
+}
+
+// ctype_from_gotype_rec returns the ffi.Type mirroring rt.
+// seen holds the declarations of the struct types being built, so that
+// recursive go types refer to them.
+func ctype_from_gotype_rec(rt reflect.Type, seen map[reflect.Type]*gostruct_decl) Type {
+	if t := associated_type(rt); t != nil {
+		return t
+	}
 	var t Type
 
 	switch rt.Kind() {
+	case reflect.Bool:
+		t = C_bool
+
 	case reflect.Int:
-		t = C_int
+		t = g_go_int
 
 	case reflect.Int8:
 		t = C_int8
@@ -540,7 +886,7 @@ func ctype_from_gotype(rt reflect.Type) Type {
 		t = C_int64
 
 	case reflect.Uint:
-		t = C_uint
+		t = g_go_uint
 
 	case reflect.Uint8:
 		t = C_uint8
@@ -554,14 +900,26 @@ func ctype_from_gotype(rt reflect.Type) Type {
 	case reflect.Uint64:
 		t = C_uint64
 
+	case reflect.Uintptr:
+		t = C_uintptr_t
+
+	case reflect.UnsafePointer:
+		t = C_pointer
+
 	case reflect.Float32:
 		t = C_float
 
 	case reflect.Float64:
 		t = C_double
 
+	case reflect.Complex64:
+		t = C_complex_float
+
+	case reflect.Complex128:
+		t = C_complex_double
+
 	case reflect.Array:
-		et := ctype_from_gotype(rt.Elem())
+		et := ctype_from_gotype_rec(rt.Elem(), seen)
 		ct, err := NewArrayType(rt.Len(), et)
 		if err != nil {
 			panic("ffi: " + err.Error())
@@ -570,7 +928,7 @@ func ctype_from_gotype(rt reflect.Type) Type {
 		t = ct
 
 	case reflect.Ptr:
-		et := ctype_from_gotype(rt.Elem())
+		et := ctype_from_gotype_rec(rt.Elem(), seen)
 		ct, err := NewPointerType(et)
 		if err != nil {
 			panic("ffi: " + err.Error())
@@ -578,7 +936,7 @@ func ctype_from_gotype(rt reflect.Type) Type {
 		t = ct
 
 	case reflect.Slice:
-		et := ctype_from_gotype(rt.Elem())
+		et := ctype_from_gotype_rec(rt.Elem(), seen)
 		ct, err := NewSliceType(et)
 		if err != nil {
 			panic("ffi: " + err.Error())
@@ -587,23 +945,27 @@ func ctype_from_gotype(rt reflect.Type) Type {
 		t = ct
 
 	case reflect.Struct:
-		fields := make([]Field, rt.NumField())
-		for i := 0; i < rt.NumField(); i++ {
-			field := rt.Field(i)
-			fields[i] = Field{
-				Name: field.Name,
-				Type: ctype_from_gotype(field.Type),
+		if rt == g_longdouble_type {
+			t = C_longdouble
+			break
+		}
+		if d, ok := seen[rt]; ok {
+			// recursive type
+			if d.t == nil {
+				d.declare(rt)
 			}
+			t = d.t
+			break
 		}
-		ct, err := NewStructType(rt.Name(), fields)
-		if err != nil {
-			panic("ffi: " + err.Error())
+		if ct := derived_type(rt); ct != nil {
+			t = ct
+			break
 		}
-		ct.set_gotype(rt)
-		t = ct
+		t = ctype_from_gostruct(rt, seen)
 
 	case reflect.String:
-		panic("unimplemented")
+		t = C_string
+
 	default:
 		panic("unhandled kind [" + rt.Kind().String() + "]")
 	}
@@ -611,9 +973,71 @@ func ctype_from_gotype(rt reflect.Type) Type {
 	return t
 }
 
+// ctype_from_gostruct returns the ffi.Type mirroring the struct type rt.
+// A named struct is only declared before being defined if it refers to
+// itself, and that declaration is undone if the struct can not be defined.
+func ctype_from_gostruct(rt reflect.Type, seen map[reflect.Type]*gostruct_decl) Type {
+	if rt.Name() != "" {
+		d := &gostruct_decl{}
+		seen[rt] = d
+		defer func() {
+			delete(seen, rt)
+			if d.created && is_incomplete(d.t) {
+				g_types.undeclare(d.t)
+			}
+		}()
+	}
+	var (
+		fields = make([]Field, 0, rt.NumField())
+		layout StructLayout
+	)
+	for i := 0; i < rt.NumField(); i++ {
+		field := rt.Field(i)
+		tag, err := parse_field_tag(field)
+		if err != nil {
+			panic("ffi: " + err.Error())
+		}
+		if tag.pack != 0 {
+			if layout.Pack != 0 && layout.Pack != tag.pack {
+				panic("ffi: inconsistent pack values in tags of struct [" + rt.String() + "]")
+			}
+			layout.Pack = tag.pack
+		}
+		if tag.skip {
+			continue
+		}
+		ft := Type(nil)
+		if tag.ctype != "" {
+			ft, err = ctype_by_name(tag.ctype)
+			if err == nil {
+				err = check_tag_type(ft, field.Type)
+			}
+			if err != nil {
+				panic("ffi: field [" + field.Name + "] of struct [" + rt.String() + "]: " + err.Error())
+			}
+		} else {
+			ft = ctype_from_gotype_rec(field.Type, seen)
+		}
+		fields = append(fields, Field{Name: tag.name, Type: ft})
+	}
+	ct, err := NewStructTypeLayout(rt.Name(), fields, layout)
+	if err != nil {
+		panic("ffi: " + err.Error())
+	}
+	ct.set_gotype(rt)
+	g_gotypes.Lock()
+	g_derived[rt] = ct
+	g_gotypes.Unlock()
+	return ct
+}
+
 // Associate creates a link b/w a ffi.Type and a reflect.Type to allow
 // automatic conversions b/w these types.
 func Associate(ct Type, rt reflect.Type) error {
+	if et, ok := ct.(*cffi_enum); ok {
+		// enums are associated to their underlying go type by default
+		return et.associate(rt)
+	}
 	crt := ct.GoType()
 	if crt != nil {
 		if crt != rt {
@@ -626,6 +1050,42 @@ func Associate(ct Type, rt reflect.Type) error {
 	if ct.GoType() != rt {
 		panic("ffi.Associate: internal error")
 	}
+	if is_incomplete(ct) {
+		// opaque types can not be derived from go types
+		g_gotypes.Lock()
+		g_assoc[rt] = ct
+		g_gotypes.Unlock()
+	}
+	return nil
+}
+
+// g_assoc holds the ffi.Types associated to go types they can not be
+// derived from, such as enums and opaque types.
+// It is protected by g_gotypes.
+var g_assoc = make(map[reflect.Type]Type)
+
+// g_derived caches the struct types derived from go types, so that
+// anonymous go structs are always mirrored by the same ffi.Type.
+// It is protected by g_gotypes.
+var g_derived = make(map[reflect.Type]Type)
+
+// derived_type returns the struct type derived from the go type rt, or nil
+func derived_type(rt reflect.Type) Type {
+	g_gotypes.RLock()
+	defer g_gotypes.RUnlock()
+	if t, ok := g_derived[rt]; ok {
+		return t
+	}
+	return nil
+}
+
+// associated_type returns the ffi.Type associated to the go type rt, or nil
+func associated_type(rt reflect.Type) Type {
+	g_gotypes.RLock()
+	defer g_gotypes.RUnlock()
+	if t, ok := g_assoc[rt]; ok {
+		return t
+	}
 	return nil
 }
 
@@ -642,6 +1102,19 @@ func PtrTo(t Type) Type {
 // TypeOf returns the ffi Type of the value in the interface{}.
 // TypeOf(nil) returns nil
 // TypeOf(reflect.Type) returns the ffi Type corresponding to the reflected value
+//
+// The fields of a go struct are mapped to C fields following their 'ffi'
+// struct tag, a comma-separated list of options:
+//
+//	Pos int      `ffi:"name=x_pos,type=short"` // C field 'short x_pos'
+//	Tag string   `ffi:"type=char[16]"`         // NUL-padded 'char Tag[16]'
+//	Aux []int    `ffi:"skip"`                  // not part of the C struct
+//	_   struct{} `ffi:"pack=1,skip"`           // '#pragma pack(1)' struct
+//
+// Encoders and decoders follow these tags.
+//
+// The types derived from go types are declared in the default registry, and
+// the types named by 'type' options are looked up in the default registry.
 func TypeOf(i interface{}) Type {
 	switch typ := i.(type) {
 	case reflect.Type:
@@ -657,16 +1130,42 @@ func TypeOf(i interface{}) Type {
 
 // is_compatible returns whether two ffi Types are binary compatible
 func is_compatible(t1, t2 Type) bool {
+	return is_compatible_rec(t1, t2, make(map[type_pair]bool))
+}
+
+type type_pair struct {
+	t1, t2 Type
+}
+
+// is_compatible_rec returns whether two ffi Types are binary compatible.
+// seen holds the pointed-at types being compared, to stop on recursive
+// types.
+func is_compatible_rec(t1, t2 Type, seen map[type_pair]bool) bool {
+	t1, t2 = flexible_base(t1), flexible_base(t2)
+	if t1 == t2 {
+		return true
+	}
+	if is_bitfield(t1) || is_bitfield(t2) {
+		// bitfields are read and written as any integer
+		k1, k2 := t1.Kind(), t2.Kind()
+		return (is_signed(k1) || is_unsigned(k1)) && (is_signed(k2) || is_unsigned(k2))
+	}
 	if t1.Kind() != t2.Kind() {
 		//FIXME: test if it is int/intX and uint/uintX
 		return false
 	}
 	switch t1.Kind() {
-	case Struct:
+	case Struct, Union:
+		if is_incomplete(t1) || is_incomplete(t2) {
+			return t1 == t2
+		}
+		if t1.NumField() != t2.NumField() {
+			return false
+		}
 		for i := 0; i < t1.NumField(); i++ {
 			f1 := t1.Field(i)
 			f2 := t2.Field(i)
-			if !is_compatible(f1.Type, f2.Type) {
+			if !is_compatible_rec(f1.Type, f2.Type, seen) {
 				return false
 			}
 		}
@@ -676,7 +1175,7 @@ func is_compatible(t1, t2 Type) bool {
 		}
 		et1 := t1.Elem()
 		et2 := t2.Elem()
-		if !is_compatible(et1, et2) {
+		if !is_compatible_rec(et1, et2, seen) {
 			return false
 		}
 		return true
@@ -684,21 +1183,51 @@ func is_compatible(t1, t2 Type) bool {
 	case Ptr:
 		et1 := t1.Elem()
 		et2 := t2.Elem()
-		if !is_compatible(et1, et2) {
+		if is_incomplete(et1) || is_incomplete(et2) {
+			// typed handles are distinct from void*
+			return et1 == et2
+		}
+		if et1.Kind() == Void || et2.Kind() == Void {
+			return true
+		}
+		p := type_pair{et1, et2}
+		if seen[p] {
+			// recursive types
+			return true
+		}
+		seen[p] = true
+		if !is_compatible_rec(et1, et2, seen) {
 			return false
 		}
 		return true
 
+	case Complex:
+		return t1.Size() == t2.Size()
+
 	case Slice:
 		et1 := t1.Elem()
 		et2 := t2.Elem()
-		if !is_compatible(et1, et2) {
+		if !is_compatible_rec(et1, et2, seen) {
 			return false
 		}
 		return true
 
 	case String:
-		panic("unimplemented: ffi.String")
+		return true
+
+	case FuncPtr:
+		if t1.NumIn() != t2.NumIn() || t1.IsVariadic() != t2.IsVariadic() {
+			return false
+		}
+		if !is_compatible_rec(t1.Out(), t2.Out(), seen) {
+			return false
+		}
+		for i := 0; i < t1.NumIn(); i++ {
+			if !is_compatible_rec(t1.In(i), t2.In(i), seen) {
+				return false
+			}
+		}
+		return true
 	}
 	return true
 }
@@ -714,19 +1243,20 @@ func init() {
 		}
 	}()
 
-	g_types = make(map[string]Type)
+	g_types.types = make(map[string]Type)
 
 	// initialize all builtin types
 	init_type := func(t Type) {
 		n := t.Name()
 		//fmt.Printf("ctype [%s] - size: %v...\n", n, t.Size())
-		if _, ok := g_types[n]; ok {
+		if _, ok := g_types.types[n]; ok {
 			//fmt.Printf("ctypes [%s] already registered\n", n)
 			return
 		}
 		//NewCif(DefaultAbi, t, nil)
 		//fmt.Printf("ctype [%s] - size: %v\n", n, t.Size())
-		g_types[n] = t
+		g_types.types[n] = t
+		g_builtins[n] = true
 	}
 
 	init_type(C_void)
@@ -751,6 +1281,27 @@ func init() {
 	init_type(C_longdouble)
 	init_type(C_pointer)
 
+	init_type(C_size_t)
+	init_type(C_ssize_t)
+	init_type(C_intptr_t)
+	init_type(C_uintptr_t)
+	init_type(C_ptrdiff_t)
+	init_type(C_bool)
+	init_type(C_wchar_t)
+	init_type(C_off_t)
+
+	init_type(C_string)
+	init_type(c_string_copied)
+	init_type(c_string_freed)
+
+	// complex types may need to be laid out
+	for _, t := range []Type{C_complex_float, C_complex_double, C_complex_longdouble} {
+		if err := layout_type(t); err != nil {
+			panic("ffi: " + err.Error())
+		}
+		init_type(t)
+	}
+
 }
 
 // make sure ffi_types satisfy ffi.Type interface
@@ -759,5 +1310,11 @@ var _ Type = (*cffi_array)(nil)
 var _ Type = (*cffi_ptr)(nil)
 var _ Type = (*cffi_slice)(nil)
 var _ Type = (*cffi_struct)(nil)
+var _ Type = (*cffi_complex)(nil)
+var _ Type = (*cffi_string)(nil)
+var _ Type = (*cffi_union)(nil)
+var _ Type = (*cffi_bitfield)(nil)
+var _ Type = (*cffi_enum)(nil)
+var _ Type = (*cffi_function)(nil)
 
 // EOF
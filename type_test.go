@@ -3,6 +3,8 @@ package ffi_test
 import (
 	"fmt"
 	"reflect"
+	"runtime"
+	"sync"
 	"testing"
 	"unsafe"
 
@@ -29,8 +31,10 @@ func TestBuiltinTypes(t *testing.T) {
 
 		{"float", ffi.C_float, reflect.TypeOf(float32(0))},
 		{"double", ffi.C_double, reflect.TypeOf(float64(0))},
-		//FIXME: use float128 when/if available
-		//{"long double", ffi.C_longdouble, reflect.TypeOf(complex128(0))},
+		{"long double", ffi.C_longdouble, reflect.TypeOf(ffi.CLongDouble{})},
+
+		{"float _Complex", ffi.C_complex_float, reflect.TypeOf(complex64(0))},
+		{"double _Complex", ffi.C_complex_double, reflect.TypeOf(complex128(0))},
 
 		{"*", ffi.C_pointer, reflect.TypeOf((*int)(nil))},
 	} {
@@ -43,6 +47,138 @@ func TestBuiltinTypes(t *testing.T) {
 	}
 }
 
+func TestPlatformTypes(t *testing.T) {
+	for _, table := range []struct {
+		n string
+		t ffi.Type
+	}{
+		{"int", ffi.C_int},
+		{"unsigned int", ffi.C_uint},
+		{"long", ffi.C_long},
+		{"unsigned long", ffi.C_ulong},
+		{"size_t", ffi.C_size_t},
+		{"ssize_t", ffi.C_ssize_t},
+		{"intptr_t", ffi.C_intptr_t},
+		{"uintptr_t", ffi.C_uintptr_t},
+		{"ptrdiff_t", ffi.C_ptrdiff_t},
+		{"_Bool", ffi.C_bool},
+		{"wchar_t", ffi.C_wchar_t},
+		{"off_t", ffi.C_off_t},
+	} {
+		size, signed := ffi.CPlatformType(table.n)
+		eq(t, table.n, table.t.Name())
+		eq(t, size, table.t.Size())
+		eq(t, int(size), table.t.Align())
+		eq(t, size, table.t.GoType().Size())
+		eq(t, table.t, ffi.TypeByName(table.n))
+
+		v := ffi.New(table.t)
+		if signed {
+			v.SetInt(-1)
+			eq(t, int64(-1), v.Int())
+			eq(t, int64(-1), v.GoValue().Int())
+		} else {
+			v.SetUint(1)
+			eq(t, uint64(1), v.Uint())
+			if table.t == ffi.C_bool {
+				eq(t, true, v.GoValue().Bool())
+			} else {
+				eq(t, uint64(1), v.GoValue().Uint())
+			}
+		}
+	}
+}
+
+func TestBoolPointerTypes(t *testing.T) {
+	for _, table := range []struct {
+		v interface{}
+		t ffi.Type
+	}{
+		{true, ffi.C_bool},
+		{uintptr(0), ffi.C_uintptr_t},
+		{unsafe.Pointer(nil), ffi.C_pointer},
+	} {
+		rt := reflect.TypeOf(table.v)
+		eq(t, table.t, ffi.TypeOf(table.v))
+		eq(t, rt, table.t.GoType())
+		eq(t, rt.Size(), table.t.Size())
+	}
+
+	type flags struct {
+		Ok   bool
+		Addr uintptr
+		Data unsafe.Pointer
+		Set  int8 `ffi:"type=_Bool"`
+	}
+	typ := ffi.TypeOf(flags{})
+	eq(t, ffi.C_bool, typ.Field(0).Type)
+	eq(t, ffi.C_uintptr_t, typ.Field(1).Type)
+	eq(t, ffi.C_pointer, typ.Field(2).Type)
+	eq(t, ffi.C_bool, typ.Field(3).Type)
+}
+
+func TestComplexTypes(t *testing.T) {
+	for _, table := range []struct {
+		t    ffi.Type
+		elem ffi.Type
+		rt   reflect.Type
+	}{
+		{ffi.C_complex_float, ffi.C_float, reflect.TypeOf(complex64(0))},
+		{ffi.C_complex_double, ffi.C_double, reflect.TypeOf(complex128(0))},
+		{ffi.C_complex_longdouble, ffi.C_longdouble, nil},
+	} {
+		eq(t, ffi.Complex, table.t.Kind())
+		eq(t, 2*table.elem.Size(), table.t.Size())
+		eq(t, table.elem.Align(), table.t.Align())
+		eq(t, table.rt, table.t.GoType())
+		eq(t, table.t, ffi.TypeByName(table.t.Name()))
+		if table.rt != nil {
+			eq(t, table.t, ffi.TypeOf(reflect.Zero(table.rt).Interface()))
+		}
+	}
+
+	ctyp, err := ffi.NewStructType("struct_cplx", []ffi.Field{
+		{"F1", ffi.C_float},
+		{"F2", ffi.C_complex_double},
+	})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	eq(t, ffi.C_double.Size(), ctyp.Field(1).Offset)
+	eq(t, 3*ffi.C_double.Size(), ctyp.Size())
+}
+
+func TestStringTypes(t *testing.T) {
+	for _, table := range []struct {
+		mode ffi.StringMode
+		n    string
+	}{
+		{ffi.StringBorrowed, "char*"},
+		{ffi.StringCopied, "char* /*copied*/"},
+		{ffi.StringCallerFrees, "char* /*caller frees*/"},
+	} {
+		typ := ffi.NewStringType(table.mode)
+		eq(t, table.n, typ.Name())
+		eq(t, ffi.String, typ.Kind())
+		eq(t, ffi.C_pointer.Size(), typ.Size())
+		eq(t, ffi.C_pointer.Align(), typ.Align())
+		eq(t, reflect.TypeOf(""), typ.GoType())
+		eq(t, typ, ffi.TypeByName(table.n))
+	}
+	eq(t, ffi.C_string, ffi.NewStringType(ffi.StringBorrowed))
+	eq(t, ffi.C_string, ffi.TypeOf("foo"))
+
+	ctyp, err := ffi.NewStructType("struct_str", []ffi.Field{
+		{"F1", ffi.C_int8},
+		{"F2", ffi.C_string},
+	})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	eq(t, ffi.C_pointer.Size(), ctyp.Field(1).Offset)
+	eq(t, 2*ffi.C_pointer.Size(), ctyp.Size())
+}
+
 func TestNewStructType(t *testing.T) {
 
 	arr10, err := ffi.NewArrayType(10, ffi.C_int32)
@@ -162,6 +298,882 @@ func TestNewStructType(t *testing.T) {
 	}
 }
 
+func TestNewUnionType(t *testing.T) {
+	bitfield := func(base ffi.Type, bits int) ffi.Type {
+		typ, err := ffi.NewBitfieldType(base, bits)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		return typ
+	}
+
+	for _, table := range []struct {
+		name   string
+		fields []ffi.Field
+		size   uintptr
+		align  int
+	}{
+		{"union_0",
+			[]ffi.Field{
+				{"I", ffi.C_int32},
+				{"F", ffi.C_float},
+				{"D", ffi.C_double},
+			},
+			8, 8,
+		},
+		{"union_1",
+			[]ffi.Field{
+				{"S", ffi.C_int16},
+				{"B", ffi.C_uint8},
+			},
+			2, 2,
+		},
+		{"union_2",
+			[]ffi.Field{
+				{"C", ffi.C_int8},
+				{"LD", ffi.C_longdouble},
+			},
+			ffi.C_longdouble.Size(), ffi.C_longdouble.Align(),
+		},
+		{"union_3",
+			[]ffi.Field{
+				{"C", ffi.C_int8},
+				{"B", bitfield(ffi.C_uint32, 3)},
+			},
+			4, 4,
+		},
+		{"union_4",
+			[]ffi.Field{
+				{"B", bitfield(ffi.C_uint16, 12)},
+				{"C", ffi.C_int8},
+			},
+			2, 2,
+		},
+	} {
+		typ, err := ffi.NewUnionType(table.name, table.fields)
+		if err != nil {
+			t.Errorf(err.Error())
+			continue
+		}
+		eq(t, table.name, typ.Name())
+		eq(t, ffi.Union, typ.Kind())
+		eq(t, table.size, typ.Size())
+		eq(t, table.align, typ.Align())
+		eq(t, len(table.fields), typ.NumField())
+		for i, f := range table.fields {
+			eq(t, f.Name, typ.Field(i).Name)
+			eq(t, f.Type, typ.Field(i).Type)
+			eq(t, uintptr(0), typ.Field(i).Offset)
+		}
+		eq(t, typ, ffi.TypeByName(table.name))
+
+		// re-declaration
+		typ2, err := ffi.NewUnionType(table.name, table.fields)
+		if err != nil {
+			t.Errorf(err.Error())
+		}
+		eq(t, typ, typ2)
+		_, err = ffi.NewUnionType(table.name, table.fields[:1])
+		if err == nil {
+			t.Errorf("failed to detect inconsistent re-declaration of [%s]", table.name)
+		}
+	}
+
+	_, err := ffi.NewUnionType("union_empty", nil)
+	if err == nil {
+		t.Errorf("failed to detect empty union")
+	}
+
+	u := ffi.TypeByName("union_0")
+	ctyp, err := ffi.NewStructType("struct_with_union", []ffi.Field{
+		{"F1", ffi.C_int8},
+		{"F2", u},
+		{"F3", ffi.C_int8},
+	})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	eq(t, uintptr(8), ctyp.Field(1).Offset)
+	eq(t, uintptr(16), ctyp.Field(2).Offset)
+	eq(t, uintptr(24), ctyp.Size())
+}
+
+func TestBitfieldStructType(t *testing.T) {
+	bitfield := func(base ffi.Type, bits int) ffi.Type {
+		typ, err := ffi.NewBitfieldType(base, bits)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		return typ
+	}
+
+	typ := bitfield(ffi.C_uint32, 3)
+	eq(t, "uint32:3", typ.Name())
+	eq(t, ffi.Uint32, typ.Kind())
+	eq(t, typ, bitfield(ffi.C_uint32, 3))
+
+	_, err := ffi.NewBitfieldType(ffi.C_double, 3)
+	if err == nil {
+		t.Errorf("failed to detect invalid bitfield type")
+	}
+	_, err = ffi.NewBitfieldType(ffi.C_uint8, 9)
+	if err == nil {
+		t.Errorf("failed to detect invalid bitfield width")
+	}
+
+	if runtime.GOARCH != "amd64" {
+		t.Skipf("expected layouts are the ones of gcc on x86_64, not on %s", runtime.GOARCH)
+	}
+
+	// expected layouts are the ones of gcc on x86_64
+	for _, table := range []struct {
+		name    string
+		fields  []ffi.Field
+		size    uintptr
+		align   int
+		offsets []uintptr
+		bitoffs []int
+	}{
+		{"bitfield_0", // struct {unsigned a:3; unsigned b:5; unsigned c:24;}
+			[]ffi.Field{
+				{"a", bitfield(ffi.C_uint32, 3)},
+				{"b", bitfield(ffi.C_uint32, 5)},
+				{"c", bitfield(ffi.C_uint32, 24)},
+			},
+			4, 4,
+			[]uintptr{0, 0, 1},
+			[]int{0, 3, 0},
+		},
+		{"bitfield_1", // struct {char a; int b:3;}
+			[]ffi.Field{
+				{"a", ffi.C_int8},
+				{"b", bitfield(ffi.C_int32, 3)},
+			},
+			4, 4,
+			[]uintptr{0, 1},
+			[]int{0, 0},
+		},
+		{"bitfield_2", // struct {int x:20; int y:14;}
+			[]ffi.Field{
+				{"x", bitfield(ffi.C_int32, 20)},
+				{"y", bitfield(ffi.C_int32, 14)},
+			},
+			8, 4,
+			[]uintptr{0, 4},
+			[]int{0, 0},
+		},
+		{"bitfield_3", // struct {short s:12; char c;}
+			[]ffi.Field{
+				{"s", bitfield(ffi.C_int16, 12)},
+				{"c", ffi.C_int8},
+			},
+			4, 2,
+			[]uintptr{0, 2},
+			[]int{0, 0},
+		},
+		{"bitfield_4", // struct {char a:2; int :0; char b:3;}
+			[]ffi.Field{
+				{"a", bitfield(ffi.C_int8, 2)},
+				{"", bitfield(ffi.C_int32, 0)},
+				{"b", bitfield(ffi.C_int8, 3)},
+			},
+			5, 1,
+			[]uintptr{0, 4, 4},
+			[]int{0, 0, 0},
+		},
+		{"bitfield_5", // struct {double d; unsigned char f:1; long long g:40; float h;}
+			[]ffi.Field{
+				{"d", ffi.C_double},
+				{"f", bitfield(ffi.C_uint8, 1)},
+				{"g", bitfield(ffi.C_int64, 40)},
+				{"h", ffi.C_float},
+			},
+			24, 8,
+			[]uintptr{0, 8, 8, 16},
+			[]int{0, 0, 1, 0},
+		},
+	} {
+		typ, err := ffi.NewStructType(table.name, table.fields)
+		if err != nil {
+			t.Errorf(err.Error())
+			continue
+		}
+		eq(t, table.size, typ.Size())
+		eq(t, table.align, typ.Align())
+		for i, f := range table.fields {
+			eq(t, f.Type, typ.Field(i).Type)
+			eq(t, table.offsets[i], typ.Field(i).Offset)
+			eq(t, table.bitoffs[i], typ.Field(i).BitOffset)
+		}
+	}
+}
+
+func TestBitfieldLongLong(t *testing.T) {
+	bitfield := func(base ffi.Type, bits int) ffi.Type {
+		typ, err := ffi.NewBitfieldType(base, bits)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		return typ
+	}
+	chars := func(n int) ffi.Type {
+		typ, err := ffi.NewArrayType(n, ffi.C_int8)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		return typ
+	}
+
+	// a long long bitfield may not span more units of the alignment of
+	// long long than long long itself: one unit of 8 bytes on x86_64, two
+	// units of 4 bytes on i386.
+	// expected layouts are the ones of gcc, as offset and bit offset of
+	// the long long bitfield, and size of the struct.
+	type layout struct {
+		offset uintptr
+		bitoff int
+		size   uintptr
+	}
+	for _, table := range []struct {
+		name   string
+		fields []ffi.Field
+		want   map[string]layout
+	}{
+		{"bitfield_ll_0", // struct {char c; long long x:40;}
+			[]ffi.Field{{"c", ffi.C_int8}, {"x", bitfield(ffi.C_int64, 40)}},
+			map[string]layout{"amd64": {1, 0, 8}, "386": {1, 0, 8}},
+		},
+		{"bitfield_ll_1", // struct {int a:30; long long x:40;}
+			[]ffi.Field{{"a", bitfield(ffi.C_int32, 30)}, {"x", bitfield(ffi.C_int64, 40)}},
+			map[string]layout{"amd64": {8, 0, 16}, "386": {4, 0, 12}},
+		},
+		{"bitfield_ll_2", // struct {char c[5]; long long x:40;}
+			[]ffi.Field{{"c", chars(5)}, {"x", bitfield(ffi.C_int64, 40)}},
+			map[string]layout{"amd64": {8, 0, 16}, "386": {5, 0, 12}},
+		},
+		{"bitfield_ll_3", // struct {char c[7]; long long x:33;}
+			[]ffi.Field{{"c", chars(7)}, {"x", bitfield(ffi.C_int64, 33)}},
+			map[string]layout{"amd64": {8, 0, 16}, "386": {7, 0, 12}},
+		},
+		{"bitfield_ll_4", // struct {short s; long long x:60;}
+			[]ffi.Field{{"s", ffi.C_int16}, {"x", bitfield(ffi.C_int64, 60)}},
+			map[string]layout{"amd64": {8, 0, 16}, "386": {4, 0, 12}},
+		},
+	} {
+		want, ok := table.want[runtime.GOARCH]
+		if !ok {
+			t.Skipf("no expected layout on %s", runtime.GOARCH)
+		}
+		typ, err := ffi.NewStructType(table.name, table.fields)
+		if err != nil {
+			t.Errorf(err.Error())
+			continue
+		}
+		x := typ.Field(len(table.fields) - 1)
+		eq(t, want.offset, x.Offset)
+		eq(t, want.bitoff, x.BitOffset)
+		eq(t, want.size, typ.Size())
+		eq(t, ffi.C_int64.Align(), typ.Align())
+	}
+}
+
+func TestStructLayout(t *testing.T) {
+	bitfield := func(base ffi.Type, bits int) ffi.Type {
+		typ, err := ffi.NewBitfieldType(base, bits)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		return typ
+	}
+
+	for _, layout := range []ffi.StructLayout{
+		{Pack: 3},
+		{Align: -1},
+		{FieldAlign: []int{1}},
+		{FieldAlign: []int{1, 6}},
+	} {
+		_, err := ffi.NewStructTypeLayout("", []ffi.Field{
+			{"a", ffi.C_int8},
+			{"b", ffi.C_int8},
+		}, layout)
+		if err == nil {
+			t.Errorf("failed to detect invalid layout %+v", layout)
+		}
+	}
+
+	if runtime.GOARCH != "amd64" {
+		t.Skipf("expected layouts are the ones of gcc on x86_64, not on %s", runtime.GOARCH)
+	}
+
+	// expected layouts are the ones of gcc on x86_64
+	for _, table := range []struct {
+		name    string
+		fields  []ffi.Field
+		layout  ffi.StructLayout
+		size    uintptr
+		align   int
+		offsets []uintptr
+		regular bool // whether the struct can be passed by value
+	}{
+		{"layout_0", // #pragma pack(1) struct {char c; int i; short s;}
+			[]ffi.Field{{"c", ffi.C_int8}, {"i", ffi.C_int32}, {"s", ffi.C_int16}},
+			ffi.StructLayout{Pack: 1},
+			7, 1,
+			[]uintptr{0, 1, 5},
+			false,
+		},
+		{"layout_1", // #pragma pack(1) struct {char c; int i __attribute__((aligned(8)));}
+			[]ffi.Field{{"c", ffi.C_int8}, {"i", ffi.C_int32}},
+			ffi.StructLayout{Pack: 1, FieldAlign: []int{0, 8}},
+			5, 1,
+			[]uintptr{0, 1},
+			false,
+		},
+		{"layout_2", // #pragma pack(2) struct {char c; int i; double d;}
+			[]ffi.Field{{"c", ffi.C_int8}, {"i", ffi.C_int32}, {"d", ffi.C_double}},
+			ffi.StructLayout{Pack: 2},
+			14, 2,
+			[]uintptr{0, 2, 6},
+			false,
+		},
+		{"layout_3", // #pragma pack(4) struct {int i; float f;}
+			[]ffi.Field{{"i", ffi.C_int32}, {"f", ffi.C_float}},
+			ffi.StructLayout{Pack: 4},
+			8, 4,
+			[]uintptr{0, 4},
+			true,
+		},
+		{"layout_4", // struct {char c; int i;} __attribute__((aligned(16)))
+			[]ffi.Field{{"c", ffi.C_int8}, {"i", ffi.C_int32}},
+			ffi.StructLayout{Align: 16},
+			16, 16,
+			[]uintptr{0, 4},
+			true,
+		},
+		{"layout_5", // struct {char c; _Alignas(8) int i;}
+			[]ffi.Field{{"c", ffi.C_int8}, {"i", ffi.C_int32}},
+			ffi.StructLayout{FieldAlign: []int{0, 8}},
+			16, 8,
+			[]uintptr{0, 8},
+			false,
+		},
+		{"layout_6", // struct {char c; int b:3 __attribute__((aligned(8)));}
+			[]ffi.Field{{"c", ffi.C_int8}, {"b", bitfield(ffi.C_int32, 3)}},
+			ffi.StructLayout{FieldAlign: []int{0, 8}},
+			16, 8,
+			[]uintptr{0, 8},
+			true,
+		},
+		{"layout_7", // #pragma pack(2) struct {short a:10; short b:10;}
+			[]ffi.Field{{"a", bitfield(ffi.C_int16, 10)}, {"b", bitfield(ffi.C_int16, 10)}},
+			ffi.StructLayout{Pack: 2},
+			4, 2,
+			[]uintptr{0, 1},
+			true,
+		},
+		{"layout_8", // #pragma pack(4) struct {char c; long long b:60;}
+			[]ffi.Field{{"c", ffi.C_int8}, {"b", bitfield(ffi.C_int64, 60)}},
+			ffi.StructLayout{Pack: 4},
+			12, 4,
+			[]uintptr{0, 1},
+			true,
+		},
+		// bitfields of packed structs straddle the units of their type,
+		// whatever the pack value.
+		{"layout_9", // #pragma pack(2) struct {char c; int x:31;}
+			[]ffi.Field{{"c", ffi.C_int8}, {"x", bitfield(ffi.C_int32, 31)}},
+			ffi.StructLayout{Pack: 2},
+			6, 2,
+			[]uintptr{0, 1},
+			true,
+		},
+		{"layout_10", // #pragma pack(2) struct {char c; short s; int x:20; int y:20;}
+			[]ffi.Field{
+				{"c", ffi.C_int8},
+				{"s", ffi.C_int16},
+				{"x", bitfield(ffi.C_int32, 20)},
+				{"y", bitfield(ffi.C_int32, 20)},
+			},
+			ffi.StructLayout{Pack: 2},
+			10, 2,
+			[]uintptr{0, 2, 4, 6},
+			true,
+		},
+		{"layout_11", // #pragma pack(8) struct {int a:30; int b:4;}
+			[]ffi.Field{{"a", bitfield(ffi.C_int32, 30)}, {"b", bitfield(ffi.C_int32, 4)}},
+			ffi.StructLayout{Pack: 8},
+			8, 4,
+			[]uintptr{0, 3},
+			true,
+		},
+		{"layout_12", // #pragma pack(16) struct {int a:30; int b:4;}
+			[]ffi.Field{{"a", bitfield(ffi.C_int32, 30)}, {"b", bitfield(ffi.C_int32, 4)}},
+			ffi.StructLayout{Pack: 16},
+			8, 4,
+			[]uintptr{0, 3},
+			true,
+		},
+		{"layout_13", // #pragma pack(4) struct {int a:30; long long x:40;}
+			[]ffi.Field{{"a", bitfield(ffi.C_int32, 30)}, {"x", bitfield(ffi.C_int64, 40)}},
+			ffi.StructLayout{Pack: 4},
+			12, 4,
+			[]uintptr{0, 3},
+			true,
+		},
+		{"layout_14", // struct {char c; int x:31;} __attribute__((packed))
+			[]ffi.Field{{"c", ffi.C_int8}, {"x", bitfield(ffi.C_int32, 31)}},
+			ffi.StructLayout{Pack: 1},
+			5, 1,
+			[]uintptr{0, 1},
+			true,
+		},
+	} {
+		typ, err := ffi.NewStructTypeLayout(table.name, table.fields, table.layout)
+		if err != nil {
+			t.Errorf(err.Error())
+			continue
+		}
+		eq(t, table.size, typ.Size())
+		eq(t, table.align, typ.Align())
+		for i := range table.fields {
+			eq(t, table.offsets[i], typ.Field(i).Offset)
+		}
+
+		_, err = ffi.NewCif(ffi.DefaultAbi, ffi.C_void, []ffi.Type{typ})
+		eq(t, table.regular, err == nil)
+		_, err = ffi.NewCif(ffi.DefaultAbi, typ, nil)
+		eq(t, table.regular, err == nil)
+
+		// pointers are fine
+		_, err = ffi.NewCif(ffi.DefaultAbi, ffi.C_void, []ffi.Type{ffi.PtrTo(typ)})
+		if err != nil {
+			t.Errorf(err.Error())
+		}
+
+		// re-declaration
+		_, err = ffi.NewStructTypeLayout(table.name, table.fields, table.layout)
+		if err != nil {
+			t.Errorf(err.Error())
+		}
+		_, err = ffi.NewStructType(table.name, table.fields)
+		if err == nil {
+			t.Errorf("failed to detect inconsistent re-declaration of [%s]", table.name)
+		}
+	}
+
+	// packed structs as members
+	packed := ffi.TypeByName("layout_0")
+	outer, err := ffi.NewStructType("layout_outer", []ffi.Field{
+		{"c", ffi.C_int8},
+		{"p", packed},
+		{"i", ffi.C_int32},
+	})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	eq(t, uintptr(1), outer.Field(1).Offset)
+	eq(t, uintptr(8), outer.Field(2).Offset)
+	eq(t, uintptr(12), outer.Size())
+	_, err = ffi.NewCif(ffi.DefaultAbi, ffi.C_void, []ffi.Type{outer})
+	if err == nil {
+		t.Errorf("failed to detect struct with a packed member passed by value")
+	}
+}
+
+func TestNewEnumType(t *testing.T) {
+	values := map[string]int64{"RED": 0, "GREEN": 1, "BLUE": 4}
+	typ, err := ffi.NewEnumType("enum_color", ffi.C_int, values)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	eq(t, "enum_color", typ.Name())
+	eq(t, ffi.C_int.Kind(), typ.Kind())
+	eq(t, ffi.C_int.Size(), typ.Size())
+	eq(t, ffi.C_int.Align(), typ.Align())
+	eq(t, ffi.C_int.GoType(), typ.GoType())
+	eq(t, typ, ffi.TypeByName("enum_color"))
+
+	dup, err := ffi.NewEnumType("enum_color", ffi.C_int, values)
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	eq(t, typ, dup)
+
+	for _, table := range []struct {
+		n      string
+		t      ffi.Type
+		values map[string]int64
+	}{
+		{"enum_color", ffi.C_uint, values},
+		{"enum_color", ffi.C_int, map[string]int64{"RED": 0, "GREEN": 2, "BLUE": 4}},
+		{"enum_bad", ffi.C_double, values},
+		{"enum_bad", ffi.C_uint8, map[string]int64{"BIG": 256}},
+		{"enum_bad", ffi.C_uint8, map[string]int64{"NEG": -1}},
+		{"enum_bad", ffi.C_int8, map[string]int64{"SMALL": -129}},
+	} {
+		_, err := ffi.NewEnumType(table.n, table.t, table.values)
+		if err == nil {
+			t.Errorf("expected an error declaring [%s] (%s, %v)", table.n, table.t.Name(), table.values)
+		}
+	}
+}
+
+func TestNewFunctionType(t *testing.T) {
+	for _, table := range []struct {
+		n        string
+		rtype    ffi.Type
+		args     []ffi.Type
+		variadic bool
+	}{
+		{"void(*)(void)", ffi.C_void, nil, false},
+		{"int32(*)(int32, double)", ffi.C_int32, []ffi.Type{ffi.C_int32, ffi.C_double}, false},
+		{"int(*)(*, ...)", ffi.C_int, []ffi.Type{ffi.C_pointer}, true},
+	} {
+		typ, err := ffi.NewFunctionType(table.rtype, table.args, table.variadic)
+		if err != nil {
+			t.Errorf(err.Error())
+			continue
+		}
+		eq(t, table.n, typ.Name())
+		eq(t, ffi.FuncPtr, typ.Kind())
+		eq(t, ffi.C_pointer.Size(), typ.Size())
+		eq(t, ffi.C_pointer.Align(), typ.Align())
+		eq(t, table.rtype, typ.Out())
+		eq(t, len(table.args), typ.NumIn())
+		for i, arg := range table.args {
+			eq(t, arg, typ.In(i))
+		}
+		eq(t, table.variadic, typ.IsVariadic())
+		eq(t, typ, ffi.TypeByName(table.n))
+
+		dup, err := ffi.NewFunctionType(table.rtype, table.args, table.variadic)
+		if err != nil {
+			t.Errorf(err.Error())
+		}
+		eq(t, typ, dup)
+	}
+
+	// struct {char c; void (*cb)(int);}
+	cb, _ := ffi.NewFunctionType(ffi.C_void, []ffi.Type{ffi.C_int}, false)
+	st, err := ffi.NewStructType("struct_cb", []ffi.Field{
+		{"c", ffi.C_char},
+		{"cb", cb},
+	})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	eq(t, 2*ffi.C_pointer.Size(), st.Size())
+	eq(t, ffi.C_pointer.Size(), st.Field(1).Offset)
+	eq(t, cb, st.Field(1).Type)
+
+	// functions can not take packed structs by value
+	packed, err := ffi.NewStructTypeLayout("struct_fct_packed", []ffi.Field{
+		{"c", ffi.C_char},
+		{"i", ffi.C_int},
+	}, ffi.StructLayout{Pack: 1})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	_, err = ffi.NewFunctionType(ffi.C_void, []ffi.Type{packed}, false)
+	if err == nil {
+		t.Errorf("expected an error taking a packed struct by value")
+	}
+}
+
+func TestOpaqueType(t *testing.T) {
+	op, err := ffi.NewOpaqueType("opaque_node")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	eq(t, "opaque_node", op.Name())
+	eq(t, ffi.Struct, op.Kind())
+	eq(t, 0, op.NumField())
+	eq(t, op, ffi.TypeByName("opaque_node"))
+
+	dup, err := ffi.NewOpaqueType("opaque_node")
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	eq(t, op, dup)
+	_, err = ffi.NewOpaqueType("int32")
+	if err == nil {
+		t.Errorf("expected an error re-declaring a builtin type as opaque")
+	}
+
+	// incomplete types can only be used behind pointers
+	ptr, err := ffi.NewPointerType(op)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	eq(t, "opaque_node*", ptr.Name())
+	_, err = ffi.NewCif(ffi.DefaultAbi, ptr, []ffi.Type{ptr})
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	_, err = ffi.NewCif(ffi.DefaultAbi, ffi.C_void, []ffi.Type{op})
+	if err == nil {
+		t.Errorf("expected an error passing an incomplete type by value")
+	}
+	_, err = ffi.NewArrayType(2, op)
+	if err == nil {
+		t.Errorf("expected an error creating an array of incomplete type")
+	}
+	_, err = ffi.NewStructType("opaque_holder", []ffi.Field{{"n", op}})
+	if err == nil {
+		t.Errorf("expected an error creating a struct with a field of incomplete type")
+	}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("expected a panic allocating an incomplete type")
+			}
+		}()
+		ffi.New(op)
+	}()
+
+	// completion
+	st, err := ffi.NewStructType("opaque_node", []ffi.Field{
+		{"n", ffi.C_int32},
+		{"next", ptr},
+	})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	eq(t, op, st)
+	eq(t, 2, op.NumField())
+	eq(t, 2*ffi.C_pointer.Size(), op.Size())
+	eq(t, op, ptr.Elem())
+	eq(t, ptr, op.Field(1).Type)
+	_, err = ffi.NewCif(ffi.DefaultAbi, ffi.C_void, []ffi.Type{op})
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	v := ffi.New(op)
+	eq(t, int(op.Size()), len(v.Buffer()))
+
+	// go handles
+	type handle struct{}
+	h, err := ffi.NewOpaqueType("opaque_handle")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	err = ffi.Associate(h, reflect.TypeOf(handle{}))
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	eq(t, h, ffi.TypeOf(handle{}))
+	eq(t, "opaque_handle*", ffi.TypeOf((*handle)(nil)).Name())
+}
+
+func TestRecursiveStructType(t *testing.T) {
+	// struct list_node { int32_t v; struct list_node *next; };
+	fwd, err := ffi.NewOpaqueType("list_node")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	node, err := ffi.NewStructType("list_node", []ffi.Field{
+		{"v", ffi.C_int32},
+		{"next", ffi.PtrTo(fwd)},
+	})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	eq(t, fwd, node)
+	eq(t, node, node.Field(1).Type.Elem())
+	eq(t, 2*ffi.C_pointer.Size(), node.Size())
+
+	// struct tree_a { struct tree_b *b; };
+	// struct tree_b { struct tree_a *a; int64_t n; };
+	fwd_b, err := ffi.NewOpaqueType("tree_b")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	a := mustNewStructType(t, "tree_a", []ffi.Field{{"b", ffi.PtrTo(fwd_b)}})
+	b := mustNewStructType(t, "tree_b", []ffi.Field{{"a", ffi.PtrTo(a)}, {"n", ffi.C_int64}})
+	eq(t, fwd_b, b)
+	eq(t, b, a.Field(0).Type.Elem())
+	eq(t, a, b.Field(0).Type.Elem())
+	eq(t, 16, int(b.Size()))
+
+	// recursive go types
+	type gnode struct {
+		V    int32
+		Next *gnode
+	}
+	gt := ffi.TypeOf(gnode{})
+	eq(t, "gnode", gt.Name())
+	eq(t, 2, gt.NumField())
+	eq(t, gt, gt.Field(1).Type.Elem())
+	eq(t, gt, ffi.TypeOf(&gnode{}).Elem())
+	eq(t, reflect.TypeOf(gnode{}), gt.GoType())
+
+	type gb struct {
+		A *struct{ B *gb }
+		N int64
+	}
+	gbt := ffi.TypeOf(gb{})
+	eq(t, gbt, gbt.Field(0).Type.Elem().Field(0).Type.Elem())
+
+	type gtree struct {
+		Kids []gtree
+	}
+	gtt := ffi.TypeOf(gtree{})
+	eq(t, gtt, gtt.Field(0).Type.Elem())
+
+	// go types which can not be mapped leave no declaration behind
+	type gplain struct {
+		C chan int
+	}
+	type gbad struct {
+		Next *gbad
+		C    chan int
+	}
+	type gdeclared struct {
+		Next *gdeclared
+		C    chan int
+	}
+	decl, err := ffi.NewOpaqueType("gdeclared")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	for _, v := range []interface{}{gplain{}, gbad{}, gdeclared{}} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("expected a panic deriving the type of %T", v)
+				}
+			}()
+			ffi.TypeOf(v)
+		}()
+	}
+	eq(t, nil, ffi.TypeByName("gplain"))
+	eq(t, nil, ffi.TypeByName("gbad"))
+	eq(t, nil, ffi.TypeByName("gbad*"))
+	eq(t, decl, ffi.TypeByName("gdeclared"))
+}
+
+func mustNewStructType(t *testing.T, name string, fields []ffi.Field) ffi.Type {
+	typ, err := ffi.NewStructType(name, fields)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	return typ
+}
+
+func TestStructTags(t *testing.T) {
+	type tagged struct {
+		X    int     `ffi:"name=x_pos,type=short"`
+		Y    int64   `ffi:"type=long"`
+		Name string  `ffi:"type=char[16]"`
+		Aux  []int   `ffi:"skip"`
+		Pad  [3]byte `ffi:"name=_pad"`
+		Z    float32
+	}
+	typ := ffi.TypeOf(tagged{})
+	eq(t, "tagged", typ.Name())
+	eq(t, 5, typ.NumField())
+	for i, table := range []struct {
+		name string
+		typ  string
+	}{
+		{"x_pos", "short"},
+		{"Y", "long"},
+		{"Name", "char[16]"},
+		{"_pad", "uint8[3]"},
+		{"Z", "float"},
+	} {
+		eq(t, table.name, typ.Field(i).Name)
+		eq(t, table.typ, typ.Field(i).Type.Name())
+	}
+	eq(t, ffi.C_short, typ.Field(0).Type)
+	eq(t, ffi.C_long, typ.Field(1).Type)
+
+	// #pragma pack(1) struct { char c; int i; }
+	type packed struct {
+		_ struct{} `ffi:"pack=1,skip"`
+		C int8
+		I int32
+	}
+	typ = ffi.TypeOf(packed{})
+	eq(t, uintptr(5), typ.Size())
+	eq(t, uintptr(1), typ.Field(1).Offset)
+
+	type pointers struct {
+		P  *int32  `ffi:"type=int*"`
+		Pp [2]uint `ffi:"type=unsigned int[2]"`
+	}
+	typ = ffi.TypeOf(pointers{})
+	eq(t, "int*", typ.Field(0).Type.Name())
+	eq(t, "unsigned int[2]", typ.Field(1).Type.Name())
+	pv := ffi.ValueOf(pointers{Pp: [2]uint{1, 1<<32 - 1}})
+	eq(t, uint64(1), pv.Field(1).Index(0).Uint())
+	eq(t, uint64(1<<32-1), pv.Field(1).Index(1).Uint())
+
+	type mixed struct {
+		U int     `ffi:"type=unsigned int"`
+		S uint    `ffi:"type=int"`
+		P uintptr `ffi:"type=intptr_t"`
+		N int     `ffi:"type=size_t"`
+		B uint8   `ffi:"type=int8"`
+	}
+	mv := ffi.ValueOf(mixed{U: 1<<32 - 1, S: 42, P: 7, N: 1 << 40, B: 127})
+	eq(t, uint64(1<<32-1), mv.Field(0).Uint())
+	eq(t, int64(42), mv.Field(1).Int())
+	eq(t, int64(7), mv.Field(2).Int())
+	eq(t, uint64(1<<40), mv.Field(3).Uint())
+	eq(t, int64(127), mv.Field(4).Int())
+	eq(t, mixed{U: 1<<32 - 1, S: 42, P: 7, N: 1 << 40, B: 127}, mv.GoValue().Interface())
+	if err := ffi.NewEncoder(mv).Encode(mixed{U: 3, S: 4, P: 5, N: 6, B: 8}); err != nil {
+		t.Fatalf(err.Error())
+	}
+	var mixed_out mixed
+	if err := ffi.NewDecoder(mv).Decode(&mixed_out); err != nil {
+		t.Fatalf(err.Error())
+	}
+	eq(t, mixed{U: 3, S: 4, P: 5, N: 6, B: 8}, mixed_out)
+
+	for _, v := range []mixed{{U: -1}, {B: 128}, {N: -1}} {
+		if err := ffi.NewEncoder(mv).Encode(v); err == nil {
+			t.Errorf("expected an error encoding %v", v)
+		}
+	}
+	mv.Field(1).SetInt(-1)
+	if err := ffi.NewDecoder(mv).Decode(&mixed_out); err == nil {
+		t.Errorf("expected an error decoding a negative int into a go uint")
+	}
+
+	for _, v := range []interface{}{
+		struct {
+			X int `ffi:"type=no_such_type"`
+		}{},
+		struct {
+			X int `ffi:"type=double"`
+		}{},
+		struct {
+			X float64 `ffi:"type=char[4]"`
+		}{},
+		struct {
+			X int `ffi:"size=4"`
+		}{},
+		struct {
+			X int `ffi:"pack=3"`
+		}{},
+		struct {
+			X int8 `ffi:"pack=1"`
+			Y int8 `ffi:"pack=2"`
+		}{},
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("expected a panic deriving the type of %T", v)
+				}
+			}()
+			ffi.TypeOf(v)
+		}()
+	}
+}
+
 func TestNewArrayType(t *testing.T) {
 
 	s_t, err := ffi.NewStructType("s_0", []ffi.Field{{"a", ffi.C_int32}})
@@ -201,9 +1213,177 @@ func TestNewArrayType(t *testing.T) {
 		eq(t, table.name, typ.Name())
 		eq(t, table.elem, typ.Elem())
 		eq(t, uintptr(table.n)*table.elem.Size(), typ.Size())
+		eq(t, table.elem.Align(), typ.Align())
 		eq(t, table.n, typ.Len())
 		eq(t, ffi.Array, typ.Kind())
 	}
+
+	_, err = ffi.NewArrayType(-1, ffi.C_int32)
+	if err == nil {
+		t.Errorf("failed to detect negative array length")
+	}
+
+	// arrays as struct members
+	char16, _ := ffi.NewArrayType(16, ffi.C_int8)
+	char3, _ := ffi.NewArrayType(3, ffi.C_int8)
+	float3, _ := ffi.NewArrayType(3, ffi.C_float)
+	for _, table := range []struct {
+		name    string
+		fields  []ffi.Field
+		size    uintptr
+		align   int
+		offsets []uintptr
+	}{
+		{"struct_arr_0", // struct {char name[16]; int x;}
+			[]ffi.Field{{"name", char16}, {"x", ffi.C_int32}},
+			20, 4,
+			[]uintptr{0, 16},
+		},
+		{"struct_arr_1", // struct {char c[3]; short s;}
+			[]ffi.Field{{"c", char3}, {"s", ffi.C_int16}},
+			6, 2,
+			[]uintptr{0, 4},
+		},
+		{"struct_arr_2", // struct {char c; float v[3]; char d;}
+			[]ffi.Field{{"c", ffi.C_int8}, {"v", float3}, {"d", ffi.C_int8}},
+			20, 4,
+			[]uintptr{0, 4, 16},
+		},
+	} {
+		typ, err := ffi.NewStructType(table.name, table.fields)
+		if err != nil {
+			t.Errorf(err.Error())
+			continue
+		}
+		eq(t, table.size, typ.Size())
+		eq(t, table.align, typ.Align())
+		for i := range table.fields {
+			eq(t, table.offsets[i], typ.Field(i).Offset)
+		}
+	}
+
+	// arrays can not be returned
+	_, err = ffi.NewCif(ffi.DefaultAbi, char16, nil)
+	if err == nil {
+		t.Errorf("failed to detect array return type")
+	}
+}
+
+func TestMultiArrayType(t *testing.T) {
+	// float m[2][3]
+	row, err := ffi.NewArrayType(3, ffi.C_float)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	m, err := ffi.NewArrayType(2, row)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	eq(t, "float[2][3]", m.Name())
+	eq(t, ffi.Array, m.Kind())
+	eq(t, 2, m.Len())
+	eq(t, row, m.Elem())
+	eq(t, uintptr(24), m.Size())
+	eq(t, 4, m.Align())
+	eq(t, m, ffi.TypeByName("float[2][3]"))
+
+	// int32 c[4][2][3]
+	i3, _ := ffi.NewArrayType(3, ffi.C_int32)
+	i23, _ := ffi.NewArrayType(2, i3)
+	cube, err := ffi.NewArrayType(4, i23)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	eq(t, "int32[4][2][3]", cube.Name())
+	eq(t, uintptr(96), cube.Size())
+
+	// go arrays of arrays
+	eq(t, m, ffi.TypeOf([2][3]float32{}))
+
+	// struct mat { float m[4][4]; int n; }
+	f4, _ := ffi.NewArrayType(4, ffi.C_float)
+	f44, _ := ffi.NewArrayType(4, f4)
+	mat, err := ffi.NewStructType("struct_mat44", []ffi.Field{
+		{"m", f44},
+		{"n", ffi.C_int32},
+	})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	eq(t, uintptr(68), mat.Size())
+	eq(t, uintptr(64), mat.Field(1).Offset)
+}
+
+func TestFlexibleStructType(t *testing.T) {
+	// struct { uint32_t len; uint8_t data[]; }
+	rec, err := ffi.NewFlexibleStructType("flex_rec", []ffi.Field{
+		{"len", ffi.C_uint32},
+	}, ffi.Field{"data", ffi.C_uint8})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	eq(t, ffi.Struct, rec.Kind())
+	eq(t, 2, rec.NumField())
+	eq(t, uintptr(4), rec.Size())
+	eq(t, 4, rec.Align())
+	eq(t, "data", rec.Field(1).Name)
+	eq(t, uintptr(4), rec.Field(1).Offset)
+	eq(t, 0, rec.Field(1).Type.Len())
+	eq(t, ffi.C_uint8, rec.Field(1).Type.Elem())
+	eq(t, rec, ffi.TypeByName("flex_rec"))
+
+	dup, err := ffi.NewFlexibleStructType("flex_rec", []ffi.Field{
+		{"len", ffi.C_uint32},
+	}, ffi.Field{"data", ffi.C_uint8})
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	eq(t, rec, dup)
+	_, err = ffi.NewStructType("flex_rec", []ffi.Field{
+		{"len", ffi.C_uint32},
+		{"data", rec.Field(1).Type},
+	})
+	if err == nil {
+		t.Errorf("expected an error re-declaring a flexible struct as a regular one")
+	}
+
+	// the flexible array member contributes to the struct alignment
+	// struct { char c; double d[]; }
+	recd, err := ffi.NewFlexibleStructType("flex_recd", []ffi.Field{
+		{"c", ffi.C_char},
+	}, ffi.Field{"d", ffi.C_double})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	eq(t, uintptr(8), recd.Size())
+	eq(t, 8, recd.Align())
+	eq(t, uintptr(8), recd.Field(1).Offset)
+
+	// flexible structs can not be passed by value, nor be members
+	_, err = ffi.NewCif(ffi.DefaultAbi, ffi.C_void, []ffi.Type{rec})
+	if err == nil {
+		t.Errorf("expected an error passing a flexible struct by value")
+	}
+	ptr, err := ffi.NewPointerType(rec)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	_, err = ffi.NewCif(ffi.DefaultAbi, ptr, []ffi.Type{ptr})
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	_, err = ffi.NewArrayType(2, rec)
+	if err == nil {
+		t.Errorf("expected an error creating an array of flexible structs")
+	}
+	_, err = ffi.NewStructType("flex_holder", []ffi.Field{{"r", rec}})
+	if err == nil {
+		t.Errorf("expected an error creating a struct with a flexible struct field")
+	}
+	_, err = ffi.NewFlexibleStructType("flex_empty", nil, ffi.Field{"data", ffi.C_uint8})
+	if err == nil {
+		t.Errorf("expected an error creating a flexible struct without other member")
+	}
 }
 
 func TestNewSliceType(t *testing.T) {
@@ -292,4 +1472,287 @@ func TestNewPointerType(t *testing.T) {
 	}
 }
 
+func TestConcurrentTypes(t *testing.T) {
+	type hammer_t struct {
+		A int32
+		B [4]float64
+		C *uint16
+	}
+	const n = 64
+	types := make([][]ffi.Type, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			s, err := ffi.NewStructType(
+				"hammer_s",
+				[]ffi.Field{
+					{"a", ffi.C_int32},
+					{"b", ffi.C_double},
+				})
+			if err != nil {
+				t.Errorf(err.Error())
+				return
+			}
+			arr, err := ffi.NewArrayType(i%4+1, s)
+			if err != nil {
+				t.Errorf(err.Error())
+				return
+			}
+			ptr, err := ffi.NewPointerType(arr)
+			if err != nil {
+				t.Errorf(err.Error())
+				return
+			}
+			typ := ffi.TypeOf(hammer_t{})
+			v := ffi.ValueOf(hammer_t{A: int32(i)})
+			if v.Field(0).Int() != int64(i) {
+				t.Errorf("goroutine #%d: expected %d, got %d", i, i, v.Field(0).Int())
+			}
+			types[i] = []ffi.Type{
+				s,
+				ffi.TypeByName("hammer_s"),
+				ffi.TypeByName(arr.Name()),
+				ptr.Elem(),
+				typ,
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	ref := types[0]
+	for _, types := range types {
+		if ref == nil || types == nil {
+			continue
+		}
+		eq(t, ref[0], types[0])
+		eq(t, ref[0], types[1])
+		eq(t, types[2], types[3])
+		eq(t, ref[4], types[4])
+		eq(t, ffi.Struct, types[4].Kind())
+		eq(t, 3, types[4].NumField())
+	}
+}
+
+func TestConcurrentOpaqueCompletion(t *testing.T) {
+	op, err := ffi.NewOpaqueType("opaque_concurrent")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	ptr := ffi.PtrTo(op)
+
+	// readers see the struct either incomplete or fully defined
+	const n = 8
+	var wg, ready sync.WaitGroup
+	done := make(chan struct{})
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		ready.Add(1)
+		go func() {
+			defer wg.Done()
+			var once sync.Once
+			defer once.Do(ready.Done)
+			for j := 0; ; j++ {
+				if j == 1 {
+					// the struct is completed while reading it
+					once.Do(ready.Done)
+				}
+				select {
+				case <-done:
+					return
+				default:
+				}
+				nf := op.NumField()
+				if nf == 0 {
+					continue
+				}
+				if nf != 2 || op.Size() != 2*ffi.C_pointer.Size() ||
+					op.Align() != int(ffi.C_pointer.Size()) || op.Field(1).Type != ptr {
+					t.Errorf("invalid definition of [%s]", op.Name())
+					return
+				}
+				_, err := ffi.NewCif(ffi.DefaultAbi, ffi.C_void, []ffi.Type{op})
+				if err != nil {
+					t.Errorf(err.Error())
+					return
+				}
+			}
+		}()
+	}
+
+	ready.Wait()
+	_, err = ffi.NewStructType("opaque_concurrent", []ffi.Field{
+		{"n", ffi.C_int64},
+		{"next", ptr},
+	})
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	close(done)
+	wg.Wait()
+	eq(t, 2, op.NumField())
+}
+
+func TestTypeRegistry(t *testing.T) {
+	r1 := ffi.NewTypeRegistry()
+	r2 := ffi.NewTypeRegistry()
+
+	c1, err := r1.NewStructType(
+		"registry_config",
+		[]ffi.Field{
+			{"a", ffi.C_int32},
+		})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	c2, err := r2.NewStructType(
+		"registry_config",
+		[]ffi.Field{
+			{"a", ffi.C_int32},
+			{"b", ffi.C_double},
+		})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if c1 == c2 {
+		t.Errorf("expected distinct types")
+	}
+	eq(t, 4, int(c1.Size()))
+	eq(t, 16, int(c2.Size()))
+	eq(t, c1, r1.TypeByName("registry_config"))
+	eq(t, c2, r2.TypeByName("registry_config"))
+	eq(t, nil, ffi.TypeByName("registry_config"))
+
+	// builtins are visible from all registries
+	eq(t, ffi.C_int32, r1.TypeByName("int32"))
+
+	// re-declarations are checked within a registry
+	_, err = r1.NewStructType(
+		"registry_config",
+		[]ffi.Field{
+			{"b", ffi.C_double},
+		})
+	if err == nil {
+		t.Errorf("expected an inconsistent re-declaration error")
+	}
+
+	// derived types live in the registry of their element type
+	p1, err := ffi.NewPointerType(c1)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	p2, err := ffi.NewPointerType(c2)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	eq(t, c1, p1.Elem())
+	eq(t, c2, p2.Elem())
+	eq(t, p1, r1.TypeByName("registry_config*"))
+	eq(t, p2, r2.TypeByName("registry_config*"))
+	eq(t, nil, ffi.TypeByName("registry_config*"))
+
+	a2, err := ffi.NewArrayType(2, c2)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	eq(t, 32, int(a2.Size()))
+	eq(t, a2, r2.TypeByName("registry_config[2]"))
+	eq(t, nil, r1.TypeByName("registry_config[2]"))
+
+	u, err := r1.NewUnionType(
+		"registry_union",
+		[]ffi.Field{
+			{"c", c1},
+			{"d", ffi.C_int64},
+		})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	eq(t, u, r1.TypeByName("registry_union"))
+	eq(t, nil, r2.TypeByName("registry_union"))
+
+	// builtins can not be shadowed
+	for _, name := range []string{"int", "double", "char*", "_Bool"} {
+		_, err = r1.NewStructType(name, []ffi.Field{{"a", ffi.C_int32}})
+		if err == nil {
+			t.Errorf("failed to detect re-declaration of builtin [%s] as a struct", name)
+		}
+		_, err = r1.NewUnionType(name, []ffi.Field{{"a", ffi.C_int32}})
+		if err == nil {
+			t.Errorf("failed to detect re-declaration of builtin [%s] as a union", name)
+		}
+		_, err = r1.NewEnumType(name, ffi.C_int, map[string]int64{"A": 0})
+		if err == nil {
+			t.Errorf("failed to detect re-declaration of builtin [%s] as an enum", name)
+		}
+		_, err = r1.NewOpaqueType(name)
+		if err == nil {
+			t.Errorf("failed to detect re-declaration of builtin [%s] as an opaque type", name)
+		}
+		eq(t, ffi.TypeByName(name), r1.TypeByName(name))
+	}
+
+	// go types are mapped in the default registry only
+	type registry_gotype struct {
+		A int32
+		B float64
+	}
+	gt := ffi.TypeOf(registry_gotype{})
+	eq(t, gt, ffi.TypeByName("registry_gotype"))
+	eq(t, gt, r1.TypeByName("registry_gotype"))
+
+	// and so are the types named by struct tags
+	type registry_tagged struct {
+		C int32 `ffi:"type=registry_config"`
+	}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("expected a panic mapping a tag naming a type of a local registry")
+			}
+		}()
+		ffi.TypeOf(registry_tagged{})
+	}()
+
+	// types derived from enums, bitfields and function types stay in the
+	// registry of the type they derive from
+	ea, err := r1.NewEnumType("registry_mode", ffi.C_int, map[string]int64{"A": 1})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	eb, err := r2.NewEnumType("registry_mode", ffi.C_uint8, map[string]int64{"B": 2})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	eq(t, ea, r1.TypeByName("registry_mode"))
+	eq(t, eb, r2.TypeByName("registry_mode"))
+	eq(t, nil, ffi.TypeByName("registry_mode"))
+	eq(t, ea, ffi.PtrTo(ea).Elem())
+	eq(t, eb, ffi.PtrTo(eb).Elem())
+	for _, e := range []ffi.Type{ea, eb} {
+		arr, err := ffi.NewArrayType(2, e)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		eq(t, e, arr.Elem())
+		eq(t, 2*e.Size(), arr.Size())
+
+		bf, err := ffi.NewBitfieldType(e, 3)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		eq(t, e.Size(), bf.Size())
+
+		fct, err := ffi.NewFunctionType(ffi.C_void, []ffi.Type{e}, false)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		eq(t, e, fct.In(0))
+		eq(t, fct, ffi.PtrTo(fct).Elem())
+	}
+	eq(t, nil, ffi.TypeByName("registry_mode:3"))
+	eq(t, nil, ffi.TypeByName("registry_mode[2]"))
+}
+
 // EOF
@@ -0,0 +1,241 @@
+package ffi
+
+// #include "ffi.h"
+import "C"
+
+import (
+	"fmt"
+)
+
+// cffi_union describes a C union.
+// libffi has no concept of union: the underlying ffi_type is a struct with
+// the size and alignment of the union, whose elements are chosen so that
+// the union is classified as it would be by the C compiler when passed by
+// value.
+type cffi_union struct {
+	cffi_struct
+}
+
+func (t *cffi_union) Kind() Kind {
+	return Union
+}
+
+// NewUnionType creates a new ffi_type describing a C-union.
+// All the fields are located at offset 0. The size of the union is the
+// size of its largest member, rounded up to its alignment, the largest
+// alignment of its members.
+// Bitfield members occupy the bytes holding their bits, from the first
+// bit of the union, and zero-width bitfields are ignored.
+func NewUnionType(name string, fields []Field) (Type, error) {
+	return g_types.NewUnionType(name, fields)
+}
+
+// NewUnionType creates a new ffi_type describing a C-union, declared in r.
+func (r *TypeRegistry) NewUnionType(name string, fields []Field) (Type, error) {
+	if name == "" {
+		// anonymous type...
+		// generate some id.
+		name = fmt.Sprintf("_ffi_anon_type_%d", <-g_id_ch)
+	}
+	if err := r.check_name(name); err != nil {
+		return nil, fmt.Errorf("ffi.NewUnionType: %v", err)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if t := r.type_by_name(name); t != nil {
+		// check the definitions are the same
+		if t.Kind() != Union || t.NumField() != len(fields) {
+			return nil, fmt.Errorf("ffi.NewUnionType: inconsistent re-declaration of [%s]", name)
+		}
+		for i := range fields {
+			if fields[i].Name != t.Field(i).Name {
+				return nil, fmt.Errorf("ffi.NewUnionType: inconsistent re-declaration of [%s] (field #%d name mismatch)", name, i)
+			}
+			if fields[i].Type != t.Field(i).Type {
+				return nil, fmt.Errorf("ffi.NewUnionType: inconsistent re-declaration of [%s] (field #%d type mismatch)", name, i)
+			}
+		}
+		return t, nil
+	}
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("ffi.NewUnionType: union [%s] has no member", name)
+	}
+	for i, f := range fields {
+		if is_incomplete(f.Type) {
+			return nil, fmt.Errorf("ffi.NewUnionType: field #%d of [%s] has incomplete type [%s]", i, name, f.Type.Name())
+		}
+		if is_flexible(f.Type) {
+			return nil, fmt.Errorf("ffi.NewUnionType: field #%d of [%s] has a flexible array member", i, name)
+		}
+	}
+
+	var (
+		size  uintptr
+		align = 1
+	)
+	for _, f := range fields {
+		sz, a := union_member_layout(f.Type)
+		if sz > size {
+			size = sz
+		}
+		if a > align {
+			align = a
+		}
+	}
+	if r := size % uintptr(align); r != 0 {
+		size += uintptr(align) - r
+	}
+
+	c := C.ffi_type{}
+	t := &cffi_union{
+		cffi_struct{
+			cffi_type: cffi_type{n: name, c: &c},
+			fields:    make([]StructField, len(fields)),
+			reg:       r,
+		},
+	}
+	for i, f := range fields {
+		t.fields[i] = StructField{Name: f.Name, Type: f.Type}
+	}
+
+	// libffi only lays out aggregates with a zero size: set our own layout.
+	cargs, irregular := union_elements(t, size, align)
+	t.irregular = irregular
+	c.size = C.size_t(size)
+	c.alignment = C.ushort(align)
+	c._type = C.FFI_TYPE_STRUCT
+	c.elements = &cargs[0]
+
+	err := layout_type(t)
+	if err != nil {
+		return nil, err
+	}
+
+	r.register(t)
+	return t, nil
+}
+
+// union_member_layout returns the size and alignment of the union member
+// of type t.
+func union_member_layout(t Type) (uintptr, int) {
+	bf, ok := t.(*cffi_bitfield)
+	if !ok {
+		return t.Size(), t.Align()
+	}
+	if bf.bits == 0 {
+		return 0, 1
+	}
+	return uintptr(bf.bits+7) / 8, t.Align()
+}
+
+// union_leaf is a scalar located at some offset within a union
+type union_leaf struct {
+	offset uintptr
+	typ    Type
+}
+
+// union_leaves appends to leaves all the scalars making up a value of type t
+// located at offset.
+func union_leaves(leaves []union_leaf, offset uintptr, t Type) []union_leaf {
+	switch t.Kind() {
+	case Struct, Union:
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			leaves = union_leaves(leaves, offset+f.Offset, f.Type)
+		}
+	case Array:
+		et := t.Elem()
+		for i := 0; i < t.Len(); i++ {
+			leaves = union_leaves(leaves, offset+uintptr(i)*et.Size(), et)
+		}
+	case Complex:
+		et := t.(*cffi_complex).elem
+		leaves = append(leaves,
+			union_leaf{offset, et},
+			union_leaf{offset + et.Size(), et},
+		)
+	default:
+		if bf, ok := t.(*cffi_bitfield); ok && bf.bits == 0 {
+			break
+		}
+		leaves = append(leaves, union_leaf{offset, t})
+	}
+	return leaves
+}
+
+// union_elements returns the NULL-terminated list of elements of the
+// libffi struct standing for the union t.
+// The union is split into eightbytes, or into chunks of its alignment if
+// smaller, as the C compiler classifies it: a long double member is a long
+// double element, a chunk only overlapped by floating point members is a
+// floating point element, and any other chunk is an integer element.
+// The union is irregular when a long double shares its bytes with other
+// members: the C compiler passes it in memory, which libffi can not be told.
+func union_elements(t Type, size uintptr, align int) ([]*C.ffi_type, bool) {
+	leaves := union_leaves(nil, 0, t)
+	chunk := uintptr(align)
+	if chunk > 8 {
+		chunk = 8
+	}
+	cargs := make([]*C.ffi_type, 0, int(size/chunk)+1)
+	irregular := false
+	for lo := uintptr(0); lo < size; {
+		hi := lo + chunk
+		used := false
+		fp := true
+		ldbl := false
+		for _, l := range leaves {
+			if l.offset >= hi || l.offset+l.typ.Size() <= lo {
+				continue
+			}
+			used = true
+			switch l.typ.Kind() {
+			case Float, Double:
+			case LongDouble:
+				ldbl = ldbl || l.offset == lo
+				fp = false
+			default:
+				fp = false
+			}
+		}
+		var et Type
+		switch {
+		case ldbl && lo+C_longdouble.Size() <= size:
+			et = C_longdouble
+			for _, l := range leaves {
+				if l.offset >= lo+et.Size() || l.offset+l.typ.Size() <= lo {
+					continue
+				}
+				if l.typ.Kind() != LongDouble || l.offset != lo {
+					irregular = true
+				}
+			}
+		case used && fp && chunk == C_float.Size():
+			et = C_float
+		case used && fp && chunk == C_double.Size():
+			et = C_double
+		default:
+			et = union_int_type(chunk)
+		}
+		cargs = append(cargs, et.cptr())
+		lo += et.Size()
+	}
+	cargs = append(cargs, nil)
+	return cargs, irregular
+}
+
+// union_int_type returns the unsigned integer type of n bytes, or the
+// largest one.
+func union_int_type(n uintptr) Type {
+	switch n {
+	case 1:
+		return C_uint8
+	case 2:
+		return C_uint16
+	case 4:
+		return C_uint32
+	}
+	return C_uint64
+}
+
+// EOF
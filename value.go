@@ -2,37 +2,19 @@ package ffi
 
 import (
 	"fmt"
+	"math"
 	"reflect"
 	"runtime"
 	"unsafe"
 )
 
-const ptrSize = unsafe.Sizeof((*byte)(nil))
-
-// TODO: This will have to go away when
-// the new gc goes in.
+// memmove copies n bytes from asrc to adst.
+// The memory areas may overlap.
 func memmove(adst, asrc unsafe.Pointer, n uintptr) {
-	dst := uintptr(adst)
-	src := uintptr(asrc)
-	switch {
-	case src < dst && src+n > dst:
-		// byte copy backward
-		// careful: i is unsigned
-		for i := n; i > 0; {
-			i--
-			*(*byte)(unsafe.Pointer(dst + i)) = *(*byte)(unsafe.Pointer(src + i))
-		}
-	case (n|src|dst)&(ptrSize-1) != 0:
-		// byte copy forward
-		for i := uintptr(0); i < n; i++ {
-			*(*byte)(unsafe.Pointer(dst + i)) = *(*byte)(unsafe.Pointer(src + i))
-		}
-	default:
-		// word copy forward
-		for i := uintptr(0); i < n; i += ptrSize {
-			*(*uintptr)(unsafe.Pointer(dst + i)) = *(*uintptr)(unsafe.Pointer(src + i))
-		}
+	if n == 0 {
+		return
 	}
+	copy(unsafe.Slice((*byte)(adst), n), unsafe.Slice((*byte)(asrc), n))
 }
 
 // methodName returns the name of the calling method,
@@ -76,13 +58,27 @@ func New(typ Type) Value {
 	if typ == nil {
 		panic("ffi: New(nil)")
 	}
-	buf := make([]byte, int(typ.Size()))
+	if is_incomplete(typ) {
+		panic("ffi: New of incomplete type [" + typ.Name() + "]")
+	}
+	// values are kept out of the tiny allocator, so that their memory is
+	// collected on its own, releasing the resources it owns. zero-sized
+	// values get an address of their own as well.
+	n := int(typ.Size())
+	if n < g_min_alloc {
+		n = g_min_alloc
+	}
+	buf := make([]byte, n)
 	ptr := unsafe.Pointer(&buf[0])
 	v := Value{typ: typ, val: ptr}
 
 	return v
 }
 
+// g_min_alloc is the minimum size of the memory allocated by New: the size
+// of the blocks of the tiny allocator, which batches smaller allocations.
+const g_min_alloc = 16
+
 // NewAt returns a Value representing a pointer to a value of the specified
 // type, using p as that pointer.
 func NewAt(typ Type, p unsafe.Pointer) Value {
@@ -106,6 +102,14 @@ func (v Value) mustBe(expected Kind) {
 	}
 }
 
+// mustBeStructOrUnion panics if v's kind is not Struct or Union.
+func (v Value) mustBeStructOrUnion() {
+	k := v.typ.Kind()
+	if k != Struct && k != Union {
+		panic("ffi: call of " + methodName() + " on " + k.String() + " Value")
+	}
+}
+
 // Addr returns a pointer value representing the address of v.
 // It panics if CanAddr() returns false.
 // Addr is typically used to obtain a pointer to a struct field.
@@ -118,6 +122,20 @@ func (v Value) Addr() Value {
 	return Value{typ, ptr}
 }
 
+// Bool returns whether v's underlying value, a C boolean or integer, is
+// non-zero.
+// It panics if v's Kind is not an integer Kind.
+func (v Value) Bool() bool {
+	k := v.Kind()
+	switch {
+	case is_signed(k):
+		return v.Int() != 0
+	case is_unsigned(k):
+		return v.Uint() != 0
+	}
+	panic(&ValueError{"ffi.Value.Bool", k})
+}
+
 // Buffer returns the underlying byte storage for this value.
 func (v Value) Buffer() []byte {
 	buf := make([]byte, 0)
@@ -147,27 +165,41 @@ func (v Value) Cap() int {
 	panic(&ValueError{"ffi.Value.Cap", k})
 }
 
+// Complex returns v's underlying value, as a complex128.
+// It panics if v's Kind is not Complex.
+func (v Value) Complex() complex128 {
+	v.mustBe(Complex)
+	re, im := v.complex_parts()
+	return complex(re.Float(), im.Float())
+}
+
 // Elem returns the value that the pointer v points to.
-// It panics if v's kind is not Ptr
+// It panics if v's kind is not Ptr.
+// It returns the zero Value if v is a nil pointer.
 func (v Value) Elem() Value {
 	v.mustBe(Ptr)
 	typ := v.typ.Elem()
 	val := v.val
 	val = *(*unsafe.Pointer)(val)
+	if val == nil {
+		return Value{}
+	}
 	return Value{typ: typ, val: val}
 }
 
-// Field returns the i'th field of the struct v.
-// It panics if v's Kind is not Struct or i is out of range.
+// Field returns the i'th field of the struct or union v.
+// It panics if v's Kind is not Struct or Union or i is out of range.
 func (v Value) Field(i int) Value {
-	v.mustBe(Struct)
-	tt := v.typ.(*cffi_struct)
-	nfields := tt.NumField()
+	v.mustBeStructOrUnion()
+	nfields := v.typ.NumField()
 	if i < 0 || i >= nfields {
 		panic("ffi: Field index out of range")
 	}
-	field := &tt.fields[i]
+	field := v.typ.Field(i)
 	typ := field.Type
+	if is_bitfield(typ) {
+		panic("ffi: Field of bitfield [" + field.Name + "], use Bitfield")
+	}
 
 	var val unsafe.Pointer
 	// Indirect.  Just bump pointer.
@@ -190,11 +222,11 @@ func (v Value) FieldByIndex(index []int) Value {
 	return v
 }
 
-// FieldByName returns the struct field with the given name.
+// FieldByName returns the struct or union field with the given name.
 // It returns the zero Value if no field was found.
-// It panics if v's Kind is not struct.
+// It panics if v's Kind is not Struct or Union.
 func (v Value) FieldByName(name string) Value {
-	v.mustBe(Struct)
+	v.mustBeStructOrUnion()
 	for i := 0; i < v.typ.NumField(); i++ {
 		if v.typ.Field(i).Name == name {
 			return v.Field(i)
@@ -210,7 +242,7 @@ func (v Value) FieldByName(name string) Value {
 }
 
 // Float returns v's underlying value, as a float64.
-// It panics if v's Kind is not Float or Double
+// It panics if v's Kind is not Float, Double or LongDouble
 func (v Value) Float() float64 {
 	k := v.typ.Kind()
 	switch k {
@@ -218,6 +250,8 @@ func (v Value) Float() float64 {
 		return float64(*(*float32)(v.val))
 	case Double:
 		return *(*float64)(v.val)
+	case LongDouble:
+		return (*(*CLongDouble)(v.val)).Float64()
 	}
 	panic(&ValueError{"ffi.Value.Float", k})
 }
@@ -229,27 +263,62 @@ func (v Value) GoValue() reflect.Value {
 		panic(fmt.Sprintf("ffi.Value.GoValue: value of type %s has no associated reflect.Type!", v.Type().Name()))
 	}
 	rv := reflect.New(rt).Elem()
+	v.get_value(rv)
+	return rv
+}
+
+// get_value assigns v to the settable go value rv.
+// Integers are converted to the integer type of rv, so that C types whose
+// size depends on the platform can be read into any Go integer.
+func (v Value) get_value(rv reflect.Value) {
+	rt := rv.Type()
+	if rt == g_longdouble_type {
+		rv.Set(reflect.ValueOf(v.CLongDouble()))
+		return
+	}
 	switch k := rt.Kind(); k {
+	case reflect.Bool:
+		rv.SetBool(v.Bool())
+
 	case reflect.Int,
 		reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-		rv.SetInt(v.Int())
+		x := v.get_int64()
+		if rv.OverflowInt(x) {
+			panic(fmt.Sprintf("ffi: value %d of c-type [%s] overflows go type [%s]", x, v.typ.Name(), rt))
+		}
+		rv.SetInt(x)
 
 	case reflect.Uint,
-		reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
-		rv.SetUint(v.Uint())
+		reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Uintptr:
+		x := v.get_uint64()
+		if rv.OverflowUint(x) {
+			panic(fmt.Sprintf("ffi: value %d of c-type [%s] overflows go type [%s]", x, v.typ.Name(), rt))
+		}
+		rv.SetUint(x)
+
+	case reflect.UnsafePointer:
+		rv.SetPointer(v.Pointer())
 
 	case reflect.Float32, reflect.Float64:
 		rv.SetFloat(v.Float())
 
+	case reflect.Complex64, reflect.Complex128:
+		rv.SetComplex(v.Complex())
+
 	case reflect.Array:
 		for i := 0; i < rt.Len(); i++ {
-			rv.Index(i).Set(v.Index(i).GoValue())
+			v.Index(i).get_value(rv.Index(i))
 		}
 
 	case reflect.Ptr:
-		//cval := v.Elem().GoValue().Addr()
-		//rv.Set(cval)
-		panic("ffi.Value.GoValue: Ptr not implemented")
+		if v.IsNil() {
+			rv.Set(reflect.Zero(rt))
+			break
+		}
+		elem := reflect.New(rt.Elem())
+		v.Elem().get_value(elem.Elem())
+		rv.Set(elem)
 
 	case reflect.Slice:
 		vlen := v.Len()
@@ -257,23 +326,39 @@ func (v Value) GoValue() reflect.Value {
 		if vlen > vcap {
 			vcap = vlen
 		}
-		rv = reflect.MakeSlice(rt, vlen, vcap)
+		rv.Set(reflect.MakeSlice(rt, vlen, vcap))
 		for i := 0; i < v.Len(); i++ {
-			rv.Index(i).Set(v.Index(i).GoValue())
+			v.Index(i).get_value(rv.Index(i))
 		}
 
 	case reflect.Struct:
-		for i := 0; i < rt.NumField(); i++ {
-			rv.Field(i).Set(v.Field(i).GoValue())
+		for i, j := range c_field_index(rt) {
+			if j < 0 || !rv.Field(i).CanSet() {
+				// skipped or blank (padding) field
+				continue
+			}
+			if is_bitfield(v.typ.Field(j).Type) {
+				x := v.Bitfield(j)
+				if f := rv.Field(i); f.CanInt() {
+					f.SetInt(x)
+				} else {
+					f.SetUint(uint64(x))
+				}
+				continue
+			}
+			v.Field(j).get_value(rv.Field(i))
 		}
 
 	case reflect.String:
-		panic("ffi.Value.GoValue: String not implemented")
+		if is_char_array(v.typ) {
+			rv.SetString(v.chars())
+			break
+		}
+		rv.SetString(v.String())
 
 	default:
 		panic("ffi.Value.GoValue: unhandled kind [" + rt.Kind().String() + "]")
 	}
-	return rv
 }
 
 // Index returns v's i'th element.
@@ -283,7 +368,7 @@ func (v Value) Index(i int) Value {
 	switch k {
 	case Array:
 		tt := v.typ.(*cffi_array)
-		if i < 0 || i > int(tt.Len()) {
+		if i < 0 || i >= int(tt.Len()) {
 			panic("ffi: array index out of range")
 		}
 		typ := tt.Elem()
@@ -325,10 +410,19 @@ func (v Value) Int() int64 {
 	panic(&ValueError{"ffi.Value.Int", k})
 }
 
+// CLongDouble returns v's underlying value, as a CLongDouble.
+// It panics if v's Kind is not LongDouble.
+func (v Value) CLongDouble() CLongDouble {
+	v.mustBe(LongDouble)
+	return *(*CLongDouble)(v.val)
+}
+
 // IsNil returns true if v is a nil value.
-// It panics if v's Kind is Ptr.
+// It panics if v's Kind is not Ptr or FuncPtr.
 func (v Value) IsNil() bool {
-	v.mustBe(Ptr)
+	if v.Kind() != FuncPtr {
+		v.mustBe(Ptr)
+	}
 	ptr := v.val
 	ptr = *(*unsafe.Pointer)(ptr)
 	return ptr == nil
@@ -369,13 +463,20 @@ func (v Value) Len() int {
 	panic("unreachable")
 }
 
-// NumField returns the number of fields in the struct v.
-// It panics if v's Kind is not Struct.
+// NumField returns the number of fields in the struct or union v.
+// It panics if v's Kind is not Struct or Union.
 func (v Value) NumField() int {
-	v.mustBe(Struct)
+	v.mustBeStructOrUnion()
 	return v.typ.NumField()
 }
 
+// Pointer returns v's underlying value, as an unsafe.Pointer.
+// It panics if v's Kind is not Ptr.
+func (v Value) Pointer() unsafe.Pointer {
+	v.mustBe(Ptr)
+	return *(*unsafe.Pointer)(v.val)
+}
+
 func (v *Value) set_field(i int, f Value) {
 
 	// fmt.Printf(":: v=0x%x i=%d f=0x%x...\n", v.UnsafeAddr(), i, f.UnsafeAddr())
@@ -388,6 +489,16 @@ func (v *Value) set_field(i int, f Value) {
 
 // SetValue assigns x to the value v.
 // It panics if the type of x isn't binary compatible with the type of v.
+//
+// A Go pointer is stored as the address of the value it points at, when
+// that value has the same memory layout in Go and in C. Otherwise, the
+// pointed at value is copied into a new C-compatible value whose address
+// is stored instead.
+// Either way, the memory is pinned and will not be moved nor collected by
+// the garbage collector, for as long as v holds its address: until another
+// pointer is stored into v or, when v has been allocated by New, until v's
+// memory has been garbage collected.
+// A nil Go pointer is stored as a NULL pointer.
 func (v *Value) SetValue(x reflect.Value) {
 	rt := x.Type()
 	ct := TypeOf(x.Interface())
@@ -400,21 +511,93 @@ func (v *Value) SetValue(x reflect.Value) {
 	v.set_value(x)
 }
 
+// get_int64 returns the C integer v as an int64, whatever its signedness.
+// It panics if v does not fit in an int64.
+func (v Value) get_int64() int64 {
+	if !is_unsigned(v.Kind()) {
+		return v.Int()
+	}
+	x := v.Uint()
+	if x > math.MaxInt64 {
+		panic(fmt.Sprintf("ffi: value %d of c-type [%s] overflows int64", x, v.typ.Name()))
+	}
+	return int64(x)
+}
+
+// get_uint64 returns the C integer v as a uint64, whatever its signedness.
+// It panics if v is negative.
+func (v Value) get_uint64() uint64 {
+	if !is_signed(v.Kind()) {
+		return v.Uint()
+	}
+	x := v.Int()
+	if x < 0 {
+		panic(fmt.Sprintf("ffi: negative value %d of c-type [%s] assigned to an unsigned go type", x, v.typ.Name()))
+	}
+	return uint64(x)
+}
+
+// set_int64 sets the C integer v to x, whatever its signedness.
+// It panics if x does not fit in the c-type of v.
+func (v Value) set_int64(x int64) {
+	if !is_unsigned(v.Kind()) {
+		if bits := 8 * v.typ.Size(); bits < 64 && (x < -1<<(bits-1) || x >= 1<<(bits-1)) {
+			panic(fmt.Sprintf("ffi: value %d overflows c-type [%s]", x, v.typ.Name()))
+		}
+		v.SetInt(x)
+		return
+	}
+	if x < 0 {
+		panic(fmt.Sprintf("ffi: negative value %d assigned to unsigned c-type [%s]", x, v.typ.Name()))
+	}
+	v.set_uint64(uint64(x))
+}
+
+// set_uint64 sets the C integer v to x, whatever its signedness.
+// It panics if x does not fit in the c-type of v.
+func (v Value) set_uint64(x uint64) {
+	if is_signed(v.Kind()) {
+		if x > math.MaxInt64 {
+			panic(fmt.Sprintf("ffi: value %d overflows c-type [%s]", x, v.typ.Name()))
+		}
+		v.set_int64(int64(x))
+		return
+	}
+	if bits := 8 * v.typ.Size(); bits < 64 && x >= 1<<bits {
+		panic(fmt.Sprintf("ffi: value %d overflows c-type [%s]", x, v.typ.Name()))
+	}
+	v.SetUint(x)
+}
+
 // set_value assigns x to the value v.
 func (v *Value) set_value(x reflect.Value) {
 	rt := x.Type()
+	if rt == g_longdouble_type {
+		v.SetCLongDouble(x.Interface().(CLongDouble))
+		return
+	}
 	switch k := rt.Kind(); k {
+	case reflect.Bool:
+		v.SetBool(x.Bool())
+
 	case reflect.Int,
 		reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-		v.SetInt(x.Int())
+		v.set_int64(x.Int())
 
 	case reflect.Uint,
-		reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
-		v.SetUint(x.Uint())
+		reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Uintptr:
+		v.set_uint64(x.Uint())
+
+	case reflect.UnsafePointer:
+		v.SetPointer(x.UnsafePointer())
 
 	case reflect.Float32, reflect.Float64:
 		v.SetFloat(x.Float())
 
+	case reflect.Complex64, reflect.Complex128:
+		v.SetComplex(x.Complex())
+
 	case reflect.Array:
 		for i := 0; i < rt.Len(); i++ {
 			vv := v.Index(i)
@@ -422,9 +605,21 @@ func (v *Value) set_value(x reflect.Value) {
 		}
 
 	case reflect.Ptr:
-		//vv := v.Elem()
-		//vv.set_value(x.Elem())
-		panic("ffi.Value.SetValue: Ptr not implemented")
+		if x.IsNil() {
+			v.SetPointer(nil)
+			break
+		}
+		et := v.typ.Elem()
+		if same_layout(et, rt.Elem()) {
+			ptr := unsafe.Pointer(x.Pointer())
+			v.SetPointer(ptr)
+			pin(v.val, ptr)
+			break
+		}
+		elem := New(et)
+		elem.set_value(x.Elem())
+		v.SetPointer(elem.val)
+		pin(v.val, elem.val)
 
 	case reflect.Slice:
 		if x.Len() > v.Cap() {
@@ -437,22 +632,224 @@ func (v *Value) set_value(x reflect.Value) {
 		}
 
 	case reflect.Struct:
-		for i := 0; i < rt.NumField(); i++ {
-			vv := v.Field(i)
+		for i, j := range c_field_index(rt) {
+			if j < 0 {
+				continue
+			}
+			if is_bitfield(v.typ.Field(j).Type) {
+				if f := x.Field(i); f.CanInt() {
+					v.SetBitfield(j, f.Int())
+				} else {
+					v.SetBitfield(j, int64(f.Uint()))
+				}
+				continue
+			}
+			vv := v.Field(j)
 			vv.set_value(x.Field(i))
-			v.set_field(i, vv)
+			v.set_field(j, vv)
 		}
 
 	case reflect.String:
-		panic("ffi.Value.SetValue: String not implemented")
+		if is_char_array(v.typ) {
+			v.set_chars(x.String())
+			break
+		}
+		v.SetString(x.String())
 
 	default:
 		panic("ffi.Value.SetValue: unhandled kind [" + rt.Kind().String() + "]")
 	}
 }
 
+// check_set_value returns an error if go-values of type rt can not be
+// assigned to values of type ct by set_value.
+func check_set_value(ct Type, rt reflect.Type) error {
+	return check_set_value_rec(ct, rt, make(map[layout_pair]bool))
+}
+
+// check_set_value_rec returns an error if go-values of type rt can not be
+// assigned to values of type ct by set_value.
+// seen holds the pointed-at types being checked, to stop on recursive types.
+func check_set_value_rec(ct Type, rt reflect.Type, seen map[layout_pair]bool) error {
+	k := ct.Kind()
+	ok := false
+	switch {
+	case rt == g_longdouble_type:
+		ok = k == LongDouble
+	case rt.Kind() == reflect.Bool,
+		rt.Kind() >= reflect.Int && rt.Kind() <= reflect.Uintptr:
+		ok = is_signed(k) || is_unsigned(k)
+	case rt.Kind() == reflect.UnsafePointer:
+		ok = is_pointer(k)
+	case rt.Kind() == reflect.Float32, rt.Kind() == reflect.Float64:
+		ok = k == Float || k == Double || k == LongDouble
+	case rt.Kind() == reflect.Complex64, rt.Kind() == reflect.Complex128:
+		ok = k == Complex
+	case rt.Kind() == reflect.String:
+		ok = k == String || is_char_array(ct)
+	case rt.Kind() == reflect.Array:
+		if k != Array || ct.Len() != rt.Len() {
+			break
+		}
+		return check_set_value_rec(ct.Elem(), rt.Elem(), seen)
+	case rt.Kind() == reflect.Slice:
+		if k != Slice {
+			break
+		}
+		return check_set_value_rec(ct.Elem(), rt.Elem(), seen)
+	case rt.Kind() == reflect.Ptr:
+		if k != Ptr {
+			break
+		}
+		et := ct.Elem()
+		if et.Kind() == Void || seen[layout_pair{et, rt.Elem()}] {
+			return nil
+		}
+		seen[layout_pair{et, rt.Elem()}] = true
+		return check_set_value_rec(et, rt.Elem(), seen)
+	case rt.Kind() == reflect.Struct:
+		if k != Struct {
+			break
+		}
+		return check_set_struct(ct, rt, seen)
+	}
+	if !ok {
+		return fmt.Errorf("go type [%s] can not be stored as c-type [%s]", rt, ct.Name())
+	}
+	return nil
+}
+
+// check_set_struct returns an error if go-values of the struct type rt can
+// not be assigned to values of the struct type ct by set_value.
+func check_set_struct(ct Type, rt reflect.Type, seen map[layout_pair]bool) error {
+	n := 0
+	for i := 0; i < rt.NumField(); i++ {
+		f := rt.Field(i)
+		tag, err := parse_field_tag(f)
+		if err != nil {
+			return err
+		}
+		if tag.skip {
+			continue
+		}
+		if n >= ct.NumField() {
+			break
+		}
+		cf := ct.Field(n)
+		n++
+		if is_bitfield(cf.Type) {
+			switch f.Type.Kind() {
+			case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+				reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+				reflect.Uintptr:
+				continue
+			}
+			return fmt.Errorf("field [%s]: go type [%s] can not be stored as bitfield [%s]",
+				f.Name, f.Type, cf.Name)
+		}
+		if err := check_set_value_rec(cf.Type, f.Type, seen); err != nil {
+			return fmt.Errorf("field [%s]: %v", f.Name, err)
+		}
+	}
+	if n != ct.NumField() {
+		return fmt.Errorf("go type [%s] has %d fields, c-type [%s] has %d fields",
+			rt, n, ct.Name(), ct.NumField())
+	}
+	return nil
+}
+
+// pin pins the Go memory ptr points at, whose address has been stored into
+// the memory at slot: ffi values are not scanned by the garbage collector.
+// ptr is unpinned when slot stores another pointer or is collected.
+func pin(slot, ptr unsafe.Pointer) {
+	p := new(runtime.Pinner)
+	p.Pin(ptr)
+	own(slot, p.Unpin)
+}
+
+// same_layout returns whether values of the go type rt have the memory
+// layout of values of the ffi type ct.
+func same_layout(ct Type, rt reflect.Type) bool {
+	return same_layout_rec(ct, rt, make(map[layout_pair]bool))
+}
+
+type layout_pair struct {
+	ct Type
+	rt reflect.Type
+}
+
+// same_layout_rec returns whether values of the go type rt have the memory
+// layout of values of the ffi type ct.
+// seen holds the pointed-at types being compared, to stop on recursive
+// types.
+func same_layout_rec(ct Type, rt reflect.Type, seen map[layout_pair]bool) bool {
+	if ct.Kind() == Void {
+		return true
+	}
+	if ct.Size() != rt.Size() || ct.Align() != rt.Align() {
+		return false
+	}
+	switch rt.Kind() {
+	case reflect.String, reflect.Slice:
+		return false
+	case reflect.Array:
+		return same_layout_rec(ct.Elem(), rt.Elem(), seen)
+	case reflect.Ptr:
+		p := layout_pair{ct.Elem(), rt.Elem()}
+		if seen[p] {
+			// recursive types
+			return true
+		}
+		seen[p] = true
+		return same_layout_rec(p.ct, p.rt, seen)
+	case reflect.Struct:
+		if rt == g_longdouble_type {
+			return true
+		}
+		if ct.Kind() != Struct || ct.NumField() != rt.NumField() {
+			return false
+		}
+		for i := 0; i < rt.NumField(); i++ {
+			cf := ct.Field(i)
+			rf := rt.Field(i)
+			if cf.Offset != rf.Offset || !same_layout_rec(cf.Type, rf.Type, seen) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// SetBool sets v's underlying value, a C boolean or integer, to 1 if x is
+// true and to 0 otherwise.
+// It panics if v's Kind is not an integer Kind.
+func (v Value) SetBool(x bool) {
+	k := v.Kind()
+	n := uint64(0)
+	if x {
+		n = 1
+	}
+	switch {
+	case is_signed(k):
+		v.SetInt(int64(n))
+	case is_unsigned(k):
+		v.SetUint(n)
+	default:
+		panic(&ValueError{"ffi.Value.SetBool", k})
+	}
+}
+
+// SetComplex sets v's underlying value to x.
+// It panics if v's Kind is not Complex.
+func (v Value) SetComplex(x complex128) {
+	v.mustBe(Complex)
+	re, im := v.complex_parts()
+	re.SetFloat(real(x))
+	im.SetFloat(imag(x))
+}
+
 // SetFloat sets v's underlying value to x.
-// It panics if v's Kind is not Float or Double, or if CanSet() is false.
+// It panics if v's Kind is not Float, Double or LongDouble, or if CanSet() is false.
 func (v Value) SetFloat(x float64) {
 	switch k := v.typ.Kind(); k {
 	default:
@@ -461,13 +858,24 @@ func (v Value) SetFloat(x float64) {
 		*(*float32)(v.val) = float32(x)
 	case Double:
 		*(*float64)(v.val) = x
+	case LongDouble:
+		*(*CLongDouble)(v.val) = NewCLongDouble(x)
 	}
 }
 
 // SetInt sets v's underlying value to x.
 // It panics if v's Kind is not Int, Int8, Int16, Int32, or Int64, or if CanSet() is false.
+// It panics if v is an enum and x is not one of its constants.
 func (v Value) SetInt(x int64) {
 	//v.mustBeAssignable()
+	if et, ok := v.typ.(*cffi_enum); ok {
+		et.check("ffi.Value.SetInt", x)
+	}
+	v.set_int(x)
+}
+
+// set_int sets v's underlying value to x, without checking enum constants.
+func (v Value) set_int(x int64) {
 	switch k := v.typ.Kind(); k {
 	default:
 		panic(&ValueError{"ffi.Value.SetInt", k})
@@ -484,6 +892,13 @@ func (v Value) SetInt(x int64) {
 	}
 }
 
+// SetCLongDouble sets v's underlying value to x.
+// It panics if v's Kind is not LongDouble.
+func (v Value) SetCLongDouble(x CLongDouble) {
+	v.mustBe(LongDouble)
+	*(*CLongDouble)(v.val) = x
+}
+
 // SetLen sets v's length to n.
 // It panics if v's Kind is not Slice or if n is negative or
 // greater than the capacity of the slice.
@@ -499,15 +914,45 @@ func (v Value) SetLen(n int) {
 }
 
 // SetPointer sets the unsafe.Pointer value v to x.
+// The Go memory pinned by a previous SetValue of v is unpinned.
+// It panics if v's Kind is not Ptr.
 func (v Value) SetPointer(x unsafe.Pointer) {
 	v.mustBe(Ptr)
 	*(*unsafe.Pointer)(v.val) = x
+	disown(v.val)
+}
+
+// SetString sets v's underlying value to a copy of x, allocated on the C heap.
+// Strings of a type with the StringCopied mode are handed over to C, which
+// becomes responsible for freeing them.
+// Otherwise, the copy is owned by v: it is freed when the string of v is set
+// again or, when v has been allocated by New, once v's memory has been
+// garbage collected. Copies of v must not outlive v.
+// It panics if v's Kind is not String.
+func (v Value) SetString(x string) {
+	v.mustBe(String)
+	cstr := c_string_new(x)
+	*(*unsafe.Pointer)(v.val) = cstr
+	if string_mode(v.typ) == StringCopied {
+		disown(v.val)
+		return
+	}
+	own(v.val, func() { c_string_free(cstr) })
 }
 
 // SetUint sets v's underlying value to x.
 // It panics if v's Kind is not Int, Int8, Int16, Int32, or Int64, or if CanSet() is false.
+// It panics if v is an enum and x is not one of its constants.
 func (v Value) SetUint(x uint64) {
 	//v.mustBeAssignable()
+	if et, ok := v.typ.(*cffi_enum); ok {
+		et.check("ffi.Value.SetUint", int64(x))
+	}
+	v.set_uint(x)
+}
+
+// set_uint sets v's underlying value to x, without checking enum constants.
+func (v Value) set_uint(x uint64) {
 	switch k := v.typ.Kind(); k {
 	default:
 		panic(&ValueError{"ffi.Value.SetUint", k})
@@ -567,6 +1012,29 @@ func (v Value) Slice(beg, end int) Value {
 	return Value{typ, unsafe.Pointer(&x)}
 }
 
+// String returns the string v's underlying value, as a string.
+// String is a special case because of Go's String method convention.
+// Unlike the other getters, it does not panic if v's Kind is not String.
+// Instead, it returns a string of the form "<T Value>" where T is v's type name.
+// The value of an enum is returned as the name of its constant, or as
+// "T(x)" if x is not a constant of T.
+// A NULL C string is returned as "".
+func (v Value) String() string {
+	if v.typ == nil {
+		return "<invalid Value>"
+	}
+	if v.typ.Kind() == String {
+		return c_string_go(*(*unsafe.Pointer)(v.val))
+	}
+	if et, ok := v.typ.(*cffi_enum); ok {
+		if is_unsigned(et.Kind()) {
+			return et.name(int64(v.Uint()))
+		}
+		return et.name(v.Int())
+	}
+	return "<" + v.typ.Name() + " Value>"
+}
+
 // Type returns v's type
 func (v Value) Type() Type {
 	return v.typ
@@ -624,9 +1092,18 @@ func ValueOf(i interface{}) Value {
 	v := Value{}
 	rv := reflect.ValueOf(i)
 	rt := rv.Type()
+	if ct := associated_type(rt); ct != nil {
+		v = New(ct)
+		v.SetValue(rv)
+		return v
+	}
 	switch rt.Kind() {
+	case reflect.Bool:
+		v = New(C_bool)
+		v.SetBool(rv.Bool())
+
 	case reflect.Int:
-		v = New(C_int)
+		v = New(g_go_int)
 		v.SetInt(rv.Int())
 
 	case reflect.Int8:
@@ -646,7 +1123,7 @@ func ValueOf(i interface{}) Value {
 		v.SetInt(rv.Int())
 
 	case reflect.Uint:
-		v = New(C_uint)
+		v = New(g_go_uint)
 		v.SetUint(rv.Uint())
 
 	case reflect.Uint8:
@@ -665,6 +1142,14 @@ func ValueOf(i interface{}) Value {
 		v = New(C_uint64)
 		v.SetUint(rv.Uint())
 
+	case reflect.Uintptr:
+		v = New(C_uintptr_t)
+		v.SetUint(rv.Uint())
+
+	case reflect.UnsafePointer:
+		v = New(C_pointer)
+		v.SetPointer(rv.UnsafePointer())
+
 	case reflect.Float32:
 		v = New(C_float)
 		v.SetFloat(rv.Float())
@@ -673,6 +1158,14 @@ func ValueOf(i interface{}) Value {
 		v = New(C_double)
 		v.SetFloat(rv.Float())
 
+	case reflect.Complex64:
+		v = New(C_complex_float)
+		v.SetComplex(rv.Complex())
+
+	case reflect.Complex128:
+		v = New(C_complex_double)
+		v.SetComplex(rv.Complex())
+
 	case reflect.Array:
 		ct := ctype_from_gotype(rt)
 		v = New(ct)
@@ -689,7 +1182,8 @@ func ValueOf(i interface{}) Value {
 		v.SetValue(rv)
 
 	case reflect.String:
-		panic("ffi.ValueOf: String unimplemented")
+		v = New(C_string)
+		v.SetString(rv.String())
 
 	case reflect.Slice:
 		ct := ctype_from_gotype(rt)
@@ -2,7 +2,10 @@ package ffi_test
 
 import (
 	"reflect"
+	"runtime"
 	"testing"
+	"time"
+	"unsafe"
 
 	ffi "github.com/sbinet/go-ffi"
 )
@@ -62,8 +65,7 @@ func TestGetSetBuiltinValue(t *testing.T) {
 		}{
 			{"float", ffi.C_float, float64(val)},
 			{"double", ffi.C_double, float64(val)},
-			//FIXME: Go has no equivalent for long double...
-			//{"long double", ffi.C_longdouble, float128(val)},
+			{"long double", ffi.C_longdouble, float64(val)},
 		} {
 			cval := ffi.New(tt.t)
 			eq(t, tt.n, cval.Type().Name())
@@ -90,6 +92,196 @@ func TestGetSetBuiltinValue(t *testing.T) {
 	}
 }
 
+func TestGetSetBoolPointerValue(t *testing.T) {
+	b := ffi.ValueOf(true)
+	eq(t, ffi.C_bool, b.Type())
+	eq(t, true, b.Bool())
+	eq(t, uint64(1), b.Uint())
+	eq(t, true, b.GoValue().Interface())
+	b.SetBool(false)
+	eq(t, false, b.Bool())
+	eq(t, []byte{0}, b.Buffer())
+
+	// any integer is a C boolean
+	i := ffi.ValueOf(int32(-2))
+	eq(t, true, i.Bool())
+	i.SetBool(true)
+	eq(t, int64(1), i.Int())
+
+	x := 42
+	p := unsafe.Pointer(&x)
+	u := ffi.ValueOf(uintptr(p))
+	eq(t, ffi.C_uintptr_t, u.Type())
+	eq(t, uint64(uintptr(p)), u.Uint())
+	eq(t, uintptr(p), u.GoValue().Interface())
+
+	v := ffi.ValueOf(p)
+	eq(t, ffi.C_pointer, v.Type())
+	eq(t, p, v.Pointer())
+	eq(t, p, v.GoValue().Interface())
+	v.SetPointer(nil)
+	eq(t, true, v.IsNil())
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("expected a panic calling Bool on a double")
+			}
+		}()
+		ffi.ValueOf(1.5).Bool()
+	}()
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("expected a panic calling Pointer on an integer")
+			}
+		}()
+		u.Pointer()
+	}()
+
+	// go structs
+	type handle struct {
+		Open bool
+		Id   uintptr
+		Ptr  unsafe.Pointer
+	}
+	h := handle{true, 7, p}
+	cval := ffi.ValueOf(h)
+	eq(t, true, cval.Field(0).Bool())
+	eq(t, uint64(7), cval.Field(1).Uint())
+	eq(t, p, cval.Field(2).Pointer())
+	eq(t, h, cval.GoValue().Interface())
+
+	var hh handle
+	err := ffi.NewDecoder(cval).Decode(&hh)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	eq(t, h, hh)
+}
+
+func TestGetSetComplexValue(t *testing.T) {
+	const val = complex(-66, 42)
+	for _, tt := range []struct {
+		n string
+		t ffi.Type
+	}{
+		{"float _Complex", ffi.C_complex_float},
+		{"double _Complex", ffi.C_complex_double},
+		{"long double _Complex", ffi.C_complex_longdouble},
+	} {
+		cval := ffi.New(tt.t)
+		eq(t, tt.n, cval.Type().Name())
+		eq(t, ffi.Complex, cval.Kind())
+		eq(t, complex128(0), cval.Complex())
+		cval.SetComplex(val)
+		eq(t, complex128(val), cval.Complex())
+	}
+
+	for _, v := range []interface{}{
+		complex64(val),
+		complex128(val),
+	} {
+		cval := ffi.ValueOf(v)
+		eq(t, complex128(val), cval.Complex())
+		eq(t, v, cval.GoValue().Interface())
+
+		// now decode back
+		vv := reflect.New(reflect.TypeOf(v))
+		dec := ffi.NewDecoder(cval)
+		err := dec.Decode(vv.Interface())
+		if err != nil {
+			t.Errorf(err.Error())
+		}
+		eq(t, v, vv.Elem().Interface())
+	}
+}
+
+func TestGetSetStringValue(t *testing.T) {
+	const val = "hello, \u00e9t\u00e9"
+	{
+		cval := ffi.New(ffi.C_string)
+		eq(t, ffi.String, cval.Kind())
+		eq(t, "", cval.String())
+		cval.SetString(val)
+		eq(t, val, cval.String())
+		eq(t, val, cval.GoValue().Interface())
+	}
+	{
+		cval := ffi.ValueOf(val)
+		eq(t, ffi.C_string, cval.Type())
+		eq(t, val, cval.String())
+
+		var str string
+		dec := ffi.NewDecoder(cval)
+		err := dec.Decode(&str)
+		if err != nil {
+			t.Errorf(err.Error())
+		}
+		eq(t, val, str)
+	}
+	{
+		type S struct {
+			I int32
+			S string
+		}
+		v := S{42, val}
+		cval := ffi.New(ffi.TypeOf(v))
+		enc := ffi.NewEncoder(cval)
+		err := enc.Encode(v)
+		if err != nil {
+			t.Errorf(err.Error())
+		}
+		eq(t, int64(42), cval.Field(0).Int())
+		eq(t, val, cval.Field(1).String())
+
+		var vv S
+		dec := ffi.NewDecoder(cval)
+		err = dec.Decode(&vv)
+		if err != nil {
+			t.Errorf(err.Error())
+		}
+		eq(t, v, vv)
+	}
+	{
+		arr := [3]string{"a", "bb", ""}
+		cval := ffi.ValueOf(arr)
+		eq(t, ffi.String, cval.Type().Elem().Kind())
+		for i := range arr {
+			eq(t, arr[i], cval.Index(i).String())
+		}
+		eq(t, arr, cval.GoValue().Interface())
+	}
+	{
+		// strings are owned by their values, and released with them
+		cvals := make([]ffi.Value, 64)
+		for i := range cvals {
+			cvals[i] = ffi.ValueOf(val)
+			cvals[i].SetString(val + val)
+			for j := 0; j < 64; j++ {
+				ffi.ValueOf(val).SetString(val)
+			}
+			runtime.GC()
+		}
+		for _, cval := range cvals {
+			eq(t, val+val, cval.String())
+		}
+	}
+	{
+		// copied strings are handed over to C
+		ctyp := ffi.NewStringType(ffi.StringCopied)
+		cval := ffi.New(ctyp)
+		cval.SetString(val)
+		eq(t, val, cval.String())
+		held := ffi.New(ctyp)
+		copy(held.Buffer(), cval.Buffer())
+		cval = ffi.Value{}
+		runtime.GC()
+		runtime.GC()
+		eq(t, val, held.String())
+	}
+}
+
 func TestGetSetArrayValue(t *testing.T) {
 
 	{
@@ -188,6 +380,126 @@ func TestGetSetArrayValue(t *testing.T) {
 		}
 	}
 
+	{
+		// zero-sized values
+		ctyp, err := ffi.NewArrayType(0, ffi.C_int32)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		eq(t, uintptr(0), ctyp.Size())
+		cval := ffi.New(ctyp)
+		eq(t, 0, cval.Len())
+		eq(t, [0]int32{}, cval.GoValue().Interface())
+	}
+}
+
+func TestGetSetMultiArrayValue(t *testing.T) {
+	// int32 m[2][3]
+	row, _ := ffi.NewArrayType(3, ffi.C_int32)
+	typ, err := ffi.NewArrayType(2, row)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	cval := ffi.New(typ)
+	for i := 0; i < 2; i++ {
+		for j := 0; j < 3; j++ {
+			cval.Index(i).Index(j).SetInt(int64(10*i + j))
+		}
+	}
+	eq(t, 3, cval.Index(1).Len())
+	eq(t, int64(12), cval.Index(1).Index(2).Int())
+	// rows are contiguous
+	buf := cval.Buffer()
+	eq(t, byte(10), buf[12])
+	eq(t, byte(2), buf[8])
+
+	gval := [2][3]int32{{0, 1, 2}, {10, 11, 12}}
+	eq(t, gval, cval.GoValue().Interface())
+
+	cval = ffi.ValueOf([2][3]int32{{-1, -2, -3}, {-4, -5, -6}})
+	eq(t, int64(-6), cval.Index(1).Index(2).Int())
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("expected a panic indexing an array out of range")
+			}
+		}()
+		cval.Index(1).Index(3)
+	}()
+}
+
+func TestGetSetFlexibleValue(t *testing.T) {
+	// struct { uint16_t len; int32_t data[]; }
+	typ, err := ffi.NewFlexibleStructType("flex_val", []ffi.Field{
+		{"len", ffi.C_uint16},
+	}, ffi.Field{"data", ffi.C_int32})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	eq(t, uintptr(4), typ.Size())
+
+	cval := ffi.NewFlexible(typ, 3)
+	eq(t, uintptr(16), cval.Type().Size())
+	eq(t, 3, cval.Field(1).Len())
+	cval.Field(0).SetUint(3)
+	for i := 0; i < 3; i++ {
+		cval.Field(1).Index(i).SetInt(int64(-i))
+	}
+	eq(t, int64(-2), cval.Field(1).Index(2).Int())
+	eq(t, 16, len(cval.Buffer()))
+
+	// values hold the flexible struct type
+	ptr := cval.Addr()
+	eq(t, ffi.PtrTo(typ), ptr.Type())
+	eq(t, typ, ptr.Elem().Type())
+	eq(t, 0, ptr.Elem().Field(1).Len())
+
+	// view a record allocated elsewhere
+	rec := ptr.Elem().Flexible(int(ptr.Elem().Field(0).Uint()))
+	eq(t, 3, rec.Field(1).Len())
+	eq(t, int64(-1), rec.Field(1).Index(1).Int())
+
+	// sized views are not registered, whatever their number of elements
+	const big = 1 << 20
+	view := ptr.Elem().Flexible(big)
+	eq(t, big, view.Field(1).Len())
+	eq(t, uintptr(4*big+4), view.Type().Size())
+	eq(t, nil, ffi.TypeByName(view.Field(1).Type().Name()))
+	eq(t, int64(-2), view.Field(1).Index(2).Int())
+
+	// the members they hold can not be used as regular array types
+	if _, err := ffi.NewArrayType(2, view.Field(1).Type()); err == nil {
+		t.Errorf("expected an error creating an array of flexible array members")
+	}
+	if _, err := ffi.NewStructType("", []ffi.Field{{"data", view.Field(1).Type()}}); err == nil {
+		t.Errorf("expected an error creating a struct with a flexible array member field")
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("expected a panic indexing a flexible array member out of range")
+			}
+		}()
+		rec.Field(1).Index(3)
+	}()
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("expected a panic indexing an empty flexible array member")
+			}
+		}()
+		ffi.New(typ).Field(1).Index(0)
+	}()
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("expected a panic allocating a regular struct with NewFlexible")
+			}
+		}()
+		ffi.NewFlexible(ffi.TypeOf(struct{ A int32 }{}), 2)
+	}()
 }
 
 func TestGetSetStructValue(t *testing.T) {
@@ -245,6 +557,379 @@ func TestGetSetStructValue(t *testing.T) {
 	eq(t, uint64(val), cval.FieldByName("F4").Uint())
 }
 
+func TestGetSetPointerValue(t *testing.T) {
+	{
+		x := int32(42)
+		cval := ffi.ValueOf(&x)
+		eq(t, ffi.Ptr, cval.Kind())
+		eq(t, false, cval.IsNil())
+		eq(t, int64(42), cval.Elem().Int())
+
+		// same memory layout: the value points at x
+		cval.Elem().SetInt(-66)
+		eq(t, int32(-66), x)
+
+		p := cval.GoValue().Interface().(*int32)
+		eq(t, int32(-66), *p)
+	}
+	{
+		var x *int32
+		cval := ffi.ValueOf(x)
+		eq(t, true, cval.IsNil())
+		eq(t, false, cval.Elem().IsValid())
+		eq(t, x, cval.GoValue().Interface())
+	}
+	{
+		type ptrs struct {
+			I int32
+			F *float64
+			S *string
+			N *int64
+		}
+		f := 42.5
+		str := "hello"
+		v := ptrs{I: 42, F: &f, S: &str}
+		cval := ffi.ValueOf(v)
+		eq(t, float64(42.5), cval.Field(1).Elem().Float())
+		eq(t, "hello", cval.Field(2).Elem().String())
+		eq(t, true, cval.Field(3).IsNil())
+
+		var vv ptrs
+		dec := ffi.NewDecoder(cval)
+		err := dec.Decode(&vv)
+		if err != nil {
+			t.Errorf(err.Error())
+		}
+		eq(t, v, vv)
+
+		// strings are copied to C memory
+		cval.Field(2).Elem().SetString("world")
+		eq(t, "hello", str)
+	}
+	{
+		// char **argv
+		argv := []*string{new(string), new(string)}
+		*argv[0] = "prog"
+		*argv[1] = "-v"
+		cval := ffi.ValueOf(argv)
+		eq(t, "char**", cval.Type().Elem().Name())
+		for i := range argv {
+			eq(t, *argv[i], cval.Index(i).Elem().String())
+		}
+	}
+	{
+		// void* accepts any pointer
+		x := 42.0
+		cval := ffi.New(ffi.C_pointer)
+		cval.SetValue(reflect.ValueOf(&x))
+		eq(t, ffi.C_void, cval.Elem().Type())
+		eq(t, uintptr(unsafe.Pointer(&x)), cval.Elem().UnsafeAddr())
+	}
+}
+
+func TestPointerValuePinning(t *testing.T) {
+	ctyp, err := ffi.NewPointerType(ffi.C_int64)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	// collected reports whether the go-value it has been given is collected
+	// after a few garbage collections.
+	collected := func(done chan struct{}) bool {
+		for i := 0; i < 10; i++ {
+			runtime.GC()
+			select {
+			case <-done:
+				return true
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+		return false
+	}
+	newval := func() (*int64, chan struct{}) {
+		x := new(int64)
+		*x = 42
+		done := make(chan struct{})
+		runtime.AddCleanup(x, func(c chan struct{}) { close(c) }, done)
+		return x, done
+	}
+
+	// the go-value is pinned for as long as the value points at it
+	x, done := newval()
+	cval := ffi.New(ctyp)
+	cval.SetValue(reflect.ValueOf(x))
+	x = nil
+	eq(t, false, collected(done))
+	eq(t, int64(42), cval.Elem().Int())
+
+	// and unpinned when the value points elsewhere
+	cval.SetPointer(nil)
+	eq(t, true, collected(done))
+
+	// or when the value is collected
+	x, done = newval()
+	cval = ffi.ValueOf(x)
+	x = nil
+	eq(t, false, collected(done))
+	eq(t, int64(42), cval.Elem().Int())
+	cval = ffi.Value{}
+	eq(t, true, collected(done))
+}
+
+func TestGetSetUnionValue(t *testing.T) {
+	typ, err := ffi.NewUnionType("union_val", []ffi.Field{
+		{"I", ffi.C_uint32},
+		{"F", ffi.C_float},
+		{"B", ffi.C_uint8},
+	})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	cval := ffi.New(typ)
+	eq(t, ffi.Union, cval.Kind())
+	eq(t, 3, cval.NumField())
+	cval.Field(1).SetFloat(1)
+	eq(t, uint64(0x3f800000), cval.Field(0).Uint())
+	eq(t, uint64(0x00), cval.FieldByName("B").Uint())
+
+	cval.FieldByName("I").SetUint(0x40400000)
+	eq(t, 3.0, cval.Field(1).Float())
+	cval.Field(2).SetUint(0x42)
+	eq(t, uint64(0x40400042), cval.Field(0).Uint())
+	eq(t, false, cval.FieldByName("X").IsValid())
+
+	// bitfields start at the first bit of the union
+	lo, _ := ffi.NewBitfieldType(ffi.C_uint32, 3)
+	sgn, _ := ffi.NewBitfieldType(ffi.C_int8, 4)
+	typ, err = ffi.NewUnionType("union_bitfield_val", []ffi.Field{
+		{"I", ffi.C_uint32},
+		{"Lo", lo},
+		{"Sgn", sgn},
+	})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	eq(t, uintptr(4), typ.Size())
+	cval = ffi.New(typ)
+	cval.SetBitfield(1, 5)
+	eq(t, int64(5), cval.Bitfield(1))
+	cval.SetBitfield(2, -3)
+	eq(t, int64(-3), cval.Bitfield(2))
+	cval.SetBitfield(2, 0)
+	eq(t, int64(0), cval.Bitfield(1))
+	cval.Field(0).SetUint(0xffffffff)
+	eq(t, int64(7), cval.Bitfield(1))
+	eq(t, int64(-1), cval.Bitfield(2))
+}
+
+func TestGetSetBitfieldValue(t *testing.T) {
+	flags, _ := ffi.NewBitfieldType(ffi.C_uint32, 3)
+	delta, _ := ffi.NewBitfieldType(ffi.C_int32, 5)
+	typ, err := ffi.NewStructType("bitfield_val", []ffi.Field{
+		{"Flags", flags},
+		{"Delta", delta},
+		{"C", ffi.C_int8},
+	})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	cval := ffi.New(typ)
+	cval.SetBitfield(0, 5)
+	cval.SetBitfield(1, -3)
+	cval.Field(2).SetInt(42)
+	eq(t, int64(5), cval.Bitfield(0))
+	eq(t, int64(-3), cval.Bitfield(1))
+	eq(t, int64(42), cval.Field(2).Int())
+	eq(t, []byte{0xed, 42, 0, 0}, cval.Buffer())
+
+	// truncation
+	cval.SetBitfield(0, -1)
+	eq(t, int64(7), cval.Bitfield(0))
+	cval.SetBitfield(1, 16)
+	eq(t, int64(-16), cval.Bitfield(1))
+	eq(t, int64(42), cval.Field(2).Int())
+
+	// go structs
+	type bits struct {
+		Flags uint8
+		Delta int
+		C     int8
+	}
+	err = ffi.Associate(typ, reflect.TypeOf(bits{}))
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	v := bits{Flags: 2, Delta: -7, C: -1}
+	enc := ffi.NewEncoder(cval)
+	err = enc.Encode(v)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	eq(t, int64(-7), cval.Bitfield(1))
+	eq(t, v, cval.GoValue().Interface())
+}
+
+func TestGetSetPackedValue(t *testing.T) {
+	b30, _ := ffi.NewBitfieldType(ffi.C_int32, 30)
+	b7, _ := ffi.NewBitfieldType(ffi.C_int32, 7)
+	// #pragma pack(1) struct {char c; int b:30; int d:7; short s;}
+	typ, err := ffi.NewStructTypeLayout("packed_val", []ffi.Field{
+		{"C", ffi.C_int8},
+		{"B", b30},
+		{"D", b7},
+		{"S", ffi.C_int16},
+	}, ffi.StructLayout{Pack: 1})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	eq(t, uintptr(8), typ.Size())
+	eq(t, uintptr(6), typ.Field(3).Offset)
+
+	cval := ffi.New(typ)
+	cval.SetBitfield(2, -1)
+	// as laid out by gcc on x86_64
+	eq(t, []byte{0, 0, 0, 0, 0xc0, 0x1f, 0, 0}, cval.Buffer())
+	eq(t, int64(-1), cval.Bitfield(2))
+	eq(t, int64(0), cval.Bitfield(1))
+
+	cval.Field(0).SetInt(-2)
+	cval.SetBitfield(1, 1<<29-1)
+	cval.Field(3).SetInt(-3)
+	eq(t, int64(-2), cval.Field(0).Int())
+	eq(t, int64(1<<29-1), cval.Bitfield(1))
+	eq(t, int64(-1), cval.Bitfield(2))
+	eq(t, int64(-3), cval.Field(3).Int())
+}
+
+func TestGetSetEnumValue(t *testing.T) {
+	typ, err := ffi.NewEnumType("enum_val", ffi.C_int32, map[string]int64{
+		"LOW":  -1,
+		"MID":  0,
+		"HIGH": 1,
+	})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	cval := ffi.New(typ)
+	eq(t, "MID", cval.String())
+	cval.SetInt(-1)
+	eq(t, int64(-1), cval.Int())
+	eq(t, "LOW", cval.String())
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("expected a panic setting an invalid enum value")
+			}
+		}()
+		cval.SetInt(2)
+	}()
+	eq(t, int64(-1), cval.Int())
+
+	// a C value not matching any constant
+	*(*int32)(unsafe.Pointer(cval.UnsafeAddr())) = 42
+	eq(t, "enum_val(42)", cval.String())
+
+	type level int32
+	err = ffi.Associate(typ, reflect.TypeOf(level(0)))
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	err = ffi.Associate(typ, reflect.TypeOf(int16(0)))
+	if err == nil {
+		t.Errorf("expected an error re-associating an enum")
+	}
+	eq(t, typ, ffi.TypeOf(level(0)))
+	v := ffi.ValueOf(level(1))
+	eq(t, typ, v.Type())
+	eq(t, "HIGH", v.String())
+	eq(t, level(1), v.GoValue().Interface())
+
+	// go structs
+	type levels struct {
+		A level
+		B level
+	}
+	styp, err := ffi.NewStructType("enum_struct", []ffi.Field{
+		{"A", typ},
+		{"B", typ},
+	})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	sval := ffi.New(styp)
+	enc := ffi.NewEncoder(sval)
+	err = enc.Encode(levels{A: -1, B: 1})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	eq(t, "LOW", sval.Field(0).String())
+	eq(t, "HIGH", sval.Field(1).String())
+
+	err = enc.Encode(levels{A: 3})
+	if err == nil {
+		t.Errorf("expected an error encoding an invalid enum value")
+	}
+
+	var out levels
+	dec := ffi.NewDecoder(sval)
+	err = dec.Decode(&out)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	eq(t, level(-1), out.A)
+	eq(t, level(1), out.B)
+}
+
+func TestGetSetRecursiveValue(t *testing.T) {
+	type rnode struct {
+		V    int32
+		Next *rnode
+	}
+	list := &rnode{1, &rnode{2, &rnode{3, nil}}}
+	cval := ffi.ValueOf(list)
+	eq(t, ffi.Ptr, cval.Kind())
+	n := cval.Elem()
+	for i := int64(1); i <= 3; i++ {
+		eq(t, i, n.Field(0).Int())
+		n = n.Field(1).Elem()
+	}
+	eq(t, false, n.IsValid())
+	eq(t, list, cval.GoValue().Interface())
+
+	// a C list
+	fwd, err := ffi.NewOpaqueType("rlist")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	typ, err := ffi.NewStructType("rlist", []ffi.Field{
+		{"v", ffi.C_int32},
+		{"next", ffi.PtrTo(fwd)},
+	})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	head := ffi.New(typ)
+	enc := ffi.NewEncoder(head)
+	err = enc.Encode(*list)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	eq(t, int64(1), head.Field(0).Int())
+	eq(t, int64(2), head.Field(1).Elem().Field(0).Int())
+	eq(t, int64(3), head.Field(1).Elem().Field(1).Elem().Field(0).Int())
+
+	var out rnode
+	dec := ffi.NewDecoder(head)
+	err = dec.Decode(&out)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	eq(t, *list, out)
+}
+
 func TestGetSetStructWithSliceValue(t *testing.T) {
 
 	const val = 42
@@ -543,6 +1228,20 @@ func TestValueOf(t *testing.T) {
 			eq(t, uint64(val), ffi.ValueOf(v).Uint())
 		}
 	}
+	{
+		// go's int and uint are not truncated to a c int
+		const max_int = int(^uint(0) >> 1)
+		v := ffi.ValueOf(max_int)
+		eq(t, unsafe.Sizeof(max_int), v.Type().Size())
+		eq(t, int64(max_int), v.Int())
+
+		u := ffi.ValueOf(^uint(0))
+		eq(t, unsafe.Sizeof(uint(0)), u.Type().Size())
+		eq(t, uint64(^uint(0)), u.Uint())
+
+		eq(t, unsafe.Sizeof(max_int), ffi.TypeOf(max_int).Size())
+		eq(t, unsafe.Sizeof(uint(0)), ffi.TypeOf(uint(0)).Size())
+	}
 	{
 		const val = 42.0
 		for _, v := range []interface{}{
@@ -996,6 +1695,66 @@ func TestEncoderDecoder(t *testing.T) {
 	}
 }
 
+func TestEncoderDecoderTags(t *testing.T) {
+	// struct rec { short id; char name[8]; long size; };
+	name8, _ := ffi.NewArrayType(8, ffi.C_char)
+	ctyp, err := ffi.NewStructType("tagged_rec", []ffi.Field{
+		{"id", ffi.C_short},
+		{"name", name8},
+		{"size", ffi.C_long},
+	})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	type rec struct {
+		ID    int    `ffi:"name=id,type=short"`
+		Name  string `ffi:"name=name,type=char[8]"`
+		Cache []byte `ffi:"skip"`
+		Size  int64  `ffi:"name=size,type=long"`
+	}
+
+	cval := ffi.New(ctyp)
+	enc := ffi.NewEncoder(cval)
+	err = enc.Encode(rec{ID: -3, Name: "abc", Cache: []byte("x"), Size: 1 << 20})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	eq(t, int64(-3), cval.Field(0).Int())
+	eq(t, []byte("abc\x00\x00\x00\x00\x00"), cval.Field(1).Buffer())
+	eq(t, int64(1<<20), cval.Field(2).Int())
+
+	var v rec
+	dec := ffi.NewDecoder(cval)
+	err = dec.Decode(&v)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	eq(t, rec{ID: -3, Name: "abc", Size: 1 << 20}, v)
+
+	// strings are truncated to, and read up to, the length of the array
+	err = enc.Encode(rec{Name: "0123456789"})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	eq(t, []byte("01234567"), cval.Field(1).Buffer())
+	err = dec.Decode(&v)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	eq(t, "01234567", v.Name)
+
+	// blank fields mirror C padding
+	type padded struct {
+		A int8
+		_ [3]byte
+		B int32
+	}
+	pval := ffi.ValueOf(padded{A: 1, B: 2})
+	eq(t, 3, pval.NumField())
+	eq(t, uintptr(4), pval.Type().Field(2).Offset)
+	eq(t, padded{A: 1, B: 2}, pval.GoValue().Interface())
+}
+
 func TestAllocValueOf(t *testing.T) {
 	const nmax = 10000
 	type Event struct {